@@ -0,0 +1,208 @@
+package gziphandler
+
+import "net/http"
+
+// Config is a declarative form of the handler's options,
+// intended to be loaded from JSON or YAML configuration
+// files.
+//
+// The zero value uses the default for every setting. Use
+// FromConfig to turn a Config into options.
+type Config struct {
+	// Level is the gzip compression level, see
+	// CompressionLevel. If nil, DefaultCompression is
+	// used.
+	Level *int `json:"level,omitempty" yaml:"level,omitempty"`
+
+	// MinSize is the minimum size of a response before it
+	// will be compressed, see MinSize. If nil, the default
+	// minimum size is used.
+	MinSize *int `json:"minSize,omitempty" yaml:"minSize,omitempty"`
+
+	// MaxBufferSize is the maximum size of a response that
+	// will be buffered in memory, see MaxBufferSize.
+	MaxBufferSize int `json:"maxBufferSize,omitempty" yaml:"maxBufferSize,omitempty"`
+
+	// ContentTypes are the MIME types to compress, see
+	// ContentTypes. If empty, any Content-Type is
+	// compressed.
+	ContentTypes []string `json:"contentTypes,omitempty" yaml:"contentTypes,omitempty"`
+
+	// ExcludeContentTypes are the MIME types to never
+	// compress, see ExcludeContentTypes.
+	ExcludeContentTypes []string `json:"excludeContentTypes,omitempty" yaml:"excludeContentTypes,omitempty"`
+
+	// ExcludePaths are URL path prefixes under which
+	// responses are never compressed. They take
+	// precedence over Rules.
+	ExcludePaths []string `json:"excludePaths,omitempty" yaml:"excludePaths,omitempty"`
+
+	// Rules override the settings above for the requests
+	// they match, see WithRules. The first matching rule
+	// is used.
+	Rules []RuleConfig `json:"rules,omitempty" yaml:"rules,omitempty"`
+
+	// Mux is the ServeMux that the Patterns of Rules are
+	// looked up in, see Pattern. It can't be loaded from a
+	// configuration file and must be set in code. Rules
+	// with Patterns are rejected if it is nil.
+	Mux *http.ServeMux `json:"-" yaml:"-"`
+}
+
+// RuleConfig is a declarative form of a Rule. A request
+// matches if it matches every one of PathPrefix, Methods
+// and Patterns that is set. A RuleConfig that sets none of
+// them matches every request.
+//
+// Settings that are nil or empty are inherited from the
+// Config.
+type RuleConfig struct {
+	// PathPrefix matches requests whose URL path begins
+	// with it.
+	PathPrefix string `json:"pathPrefix,omitempty" yaml:"pathPrefix,omitempty"`
+
+	// Methods matches requests with any of the given
+	// methods.
+	Methods []string `json:"methods,omitempty" yaml:"methods,omitempty"`
+
+	// Patterns matches requests that Config.Mux routes to
+	// any of the given patterns, see Pattern. It requires
+	// Config.Mux to be set.
+	Patterns []string `json:"patterns,omitempty" yaml:"patterns,omitempty"`
+
+	// Disable turns off compression for the requests the
+	// rule matches.
+	Disable bool `json:"disable,omitempty" yaml:"disable,omitempty"`
+
+	// Level is the gzip compression level for matching
+	// requests, see CompressionLevel. If nil, the Config's
+	// Level is used.
+	Level *int `json:"level,omitempty" yaml:"level,omitempty"`
+
+	// MinSize is the minimum size of a response before it
+	// will be compressed, see MinSize. If nil, the Config's
+	// MinSize is used.
+	MinSize *int `json:"minSize,omitempty" yaml:"minSize,omitempty"`
+
+	// MaxBufferSize is the maximum size of a response that
+	// will be buffered in memory, see MaxBufferSize. If
+	// nil, the Config's MaxBufferSize is used. Zero buffers
+	// responses only until they reach MinSize.
+	MaxBufferSize *int `json:"maxBufferSize,omitempty" yaml:"maxBufferSize,omitempty"`
+
+	// ContentTypes are the MIME types to compress, see
+	// ContentTypes. If empty, the Config's ContentTypes
+	// are used.
+	ContentTypes []string `json:"contentTypes,omitempty" yaml:"contentTypes,omitempty"`
+
+	// ExcludeContentTypes are the MIME types to never
+	// compress, see ExcludeContentTypes. If empty, the
+	// Config's ExcludeContentTypes are used.
+	ExcludeContentTypes []string `json:"excludeContentTypes,omitempty" yaml:"excludeContentTypes,omitempty"`
+}
+
+// FromConfig returns the options described by cfg. Invalid
+// settings are reported by New, or by Validate.
+func FromConfig(cfg Config) []Option {
+	var opts []Option
+
+	if cfg.Level != nil {
+		opts = append(opts, CompressionLevel(*cfg.Level))
+	}
+
+	if cfg.MinSize != nil {
+		opts = append(opts, MinSize(*cfg.MinSize))
+	}
+
+	if cfg.MaxBufferSize != 0 {
+		opts = append(opts, MaxBufferSize(cfg.MaxBufferSize))
+	}
+
+	if len(cfg.ContentTypes) != 0 {
+		opts = append(opts, ContentTypes(cfg.ContentTypes))
+	}
+
+	if len(cfg.ExcludeContentTypes) != 0 {
+		opts = append(opts, ExcludeContentTypes(cfg.ExcludeContentTypes))
+	}
+
+	var rules Rules
+
+	for _, prefix := range cfg.ExcludePaths {
+		rules = append(rules, Rule{
+			Match:   PathPrefix(prefix),
+			Options: []Option{ShouldGzip(skipGzip)},
+		})
+	}
+
+	for i, rc := range cfg.Rules {
+		if len(rc.Patterns) != 0 && cfg.Mux == nil {
+			opts = append(opts, errorOption("rule %d: Patterns require Config.Mux to be set",
+				len(cfg.ExcludePaths)+i))
+		}
+
+		rules = append(rules, rc.rule(cfg.Mux))
+	}
+
+	if len(rules) != 0 {
+		opts = append(opts, WithRules(rules))
+	}
+
+	return opts
+}
+
+func (rc RuleConfig) rule(mux *http.ServeMux) Rule {
+	var matchers []Matcher
+
+	if rc.PathPrefix != "" {
+		matchers = append(matchers, PathPrefix(rc.PathPrefix))
+	}
+
+	if len(rc.Methods) != 0 {
+		matchers = append(matchers, Methods(rc.Methods...))
+	}
+
+	if len(rc.Patterns) != 0 {
+		matchers = append(matchers, Pattern(mux, rc.Patterns...))
+	}
+
+	var opts []Option
+
+	if rc.Disable {
+		opts = append(opts, ShouldGzip(skipGzip))
+	}
+
+	if rc.Level != nil {
+		opts = append(opts, CompressionLevel(*rc.Level))
+	}
+
+	if rc.MinSize != nil {
+		opts = append(opts, MinSize(*rc.MinSize))
+	}
+
+	if rc.MaxBufferSize != nil {
+		opts = append(opts, MaxBufferSize(*rc.MaxBufferSize))
+	}
+
+	if len(rc.ContentTypes) != 0 {
+		opts = append(opts, ContentTypes(rc.ContentTypes))
+	}
+
+	if len(rc.ExcludeContentTypes) != 0 {
+		opts = append(opts, ExcludeContentTypes(rc.ExcludeContentTypes))
+	}
+
+	return Rule{
+		Match:   All(matchers...),
+		Options: opts,
+	}
+}
+
+func skipGzip(*http.Request) ShouldGzipType { return SkipGzip }
+
+// Validate reports whether cfg describes a valid set of
+// options. It returns the same error that New would.
+func (cfg Config) Validate() error {
+	_, err := New(http.NotFoundHandler(), FromConfig(cfg)...)
+	return err
+}
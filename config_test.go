@@ -0,0 +1,157 @@
+package gziphandler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `{
+	"level": 1,
+	"minSize": 0,
+	"contentTypes": ["text/*", "application/json"],
+	"excludeContentTypes": ["text/event-stream"],
+	"excludePaths": ["/metrics"],
+	"rules": [
+		{"pathPrefix": "/static/", "level": 9},
+		{"pathPrefix": "/api/", "methods": ["POST"], "disable": true}
+	]
+}`
+
+func TestFromConfig(t *testing.T) {
+	var cfg Config
+	require.NoError(t, json.Unmarshal([]byte(testConfig), &cfg))
+	require.NoError(t, cfg.Validate())
+
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		io.WriteString(w, "test")
+	}), FromConfig(cfg)...)
+
+	for _, tc := range []struct {
+		method, target string
+		expect         bool
+		level          int
+	}{
+		{http.MethodGet, "/?type=text/plain", true, BestSpeed},
+		{http.MethodGet, "/?type=application/json", true, BestSpeed},
+		{http.MethodGet, "/?type=image/png", false, 0},
+		{http.MethodGet, "/?type=text/event-stream", false, 0},
+		{http.MethodGet, "/metrics?type=text/plain", false, 0},
+		{http.MethodGet, "/static/?type=text/css", true, BestCompression},
+		{http.MethodGet, "/api/?type=application/json", true, BestSpeed},
+		{http.MethodPost, "/api/?type=application/json", false, 0},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		if tc.expect {
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "%+v", tc)
+			assert.Equal(t, gzipStrLevel("test", tc.level), resp.Body.Bytes(), "%+v", tc)
+		} else {
+			assert.Equal(t, "", res.Header.Get("Content-Encoding"), "%+v", tc)
+			assert.Equal(t, "test", resp.Body.String(), "%+v", tc)
+		}
+	}
+}
+
+func TestFromConfigZero(t *testing.T) {
+	assert.Empty(t, FromConfig(Config{}))
+	assert.NoError(t, Config{}.Validate())
+}
+
+func TestFromConfigPatterns(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	})
+
+	cfg := Config{
+		Rules: []RuleConfig{{Patterns: []string{"/static/"}, Disable: true}},
+		Mux:   mux,
+	}
+	require.NoError(t, cfg.Validate())
+
+	// The handler wraps the mux, so the pattern is looked
+	// up in Config.Mux.
+	handler := Gzip(mux, FromConfig(cfg)...)
+
+	for _, tc := range []struct {
+		target string
+		expect bool
+	}{
+		{"/static/app.js", false},
+		{"/index.html", true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		if tc.expect {
+			assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"), tc.target)
+		} else {
+			assert.Equal(t, "", resp.Header().Get("Content-Encoding"), tc.target)
+		}
+	}
+}
+
+func TestConfigYAMLTags(t *testing.T) {
+	// YAML decoders ignore json tags, so every field must
+	// carry a matching yaml tag.
+	for _, typ := range []reflect.Type{
+		reflect.TypeOf(Config{}),
+		reflect.TypeOf(RuleConfig{}),
+	} {
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			assert.NotEmpty(t, f.Tag.Get("json"), "%s.%s", typ.Name(), f.Name)
+			assert.Equal(t, f.Tag.Get("json"), f.Tag.Get("yaml"), "%s.%s", typ.Name(), f.Name)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	level := 42
+
+	for _, tc := range []struct {
+		cfg Config
+		err string
+	}{
+		{Config{Level: &level}, "invalid compression level requested: 42"},
+		{Config{MaxBufferSize: -10}, "maximum buffer size must not be negative: -10"},
+		{
+			Config{
+				ContentTypes:        []string{"text/html", "text/plain"},
+				ExcludeContentTypes: []string{"text/*"},
+			},
+			`ContentTypes ["text/html" "text/plain"] are all excluded by ExcludeContentTypes ["text/*"]`,
+		},
+		{
+			Config{Rules: []RuleConfig{{PathPrefix: "/", Level: &level}}},
+			"rule 0: invalid compression level requested: 42",
+		},
+		{
+			Config{ExcludePaths: []string{"/metrics"}, Rules: []RuleConfig{{ContentTypes: []string{"text"}}}},
+			`rule 1: invalid MIME type given to ContentTypes: "text"`,
+		},
+		{
+			Config{ExcludePaths: []string{"/metrics"}, Rules: []RuleConfig{{Patterns: []string{"/static/"}}}},
+			"rule 1: Patterns require Config.Mux to be set",
+		},
+	} {
+		assert.EqualError(t, tc.cfg.Validate(), "gziphandler: "+tc.err)
+	}
+}
@@ -0,0 +1,112 @@
+package gziphandler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"io"
+)
+
+// DigestAlgorithm is a hash algorithm used to compute the
+// Content-Digest and Repr-Digest fields defined in
+// RFC 9530.
+type DigestAlgorithm int
+
+const (
+	// SHA256 computes a sha-256 digest.
+	SHA256 DigestAlgorithm = iota + 1
+
+	// SHA512 computes a sha-512 digest.
+	SHA512
+)
+
+func (alg DigestAlgorithm) valid() bool {
+	return alg == SHA256 || alg == SHA512
+}
+
+// key returns the algorithm key used in the Digest field
+// dictionary, as registered in the Hash Algorithms for HTTP
+// Digest Fields registry.
+func (alg DigestAlgorithm) key() string {
+	switch alg {
+	case SHA256:
+		return "sha-256"
+	case SHA512:
+		return "sha-512"
+	default:
+		panic("gziphandler: invalid digest algorithm")
+	}
+}
+
+func (alg DigestAlgorithm) new() hash.Hash {
+	switch alg {
+	case SHA256:
+		return sha256.New()
+	case SHA512:
+		return sha512.New()
+	default:
+		panic("gziphandler: invalid digest algorithm")
+	}
+}
+
+// digestFields are the fields that describe the encoded
+// representation. Any value the wrapped handler set for
+// these describes the identity bytes and is wrong once the
+// response is compressed.
+var digestFields = [...]string{"Content-Digest", "Repr-Digest"}
+
+// digestWriter hashes everything written through it to the
+// underlying io.Writer.
+type digestWriter struct {
+	w io.Writer
+
+	algs   []DigestAlgorithm
+	hashes []hash.Hash
+}
+
+func newDigestWriter(w io.Writer, algs []DigestAlgorithm) *digestWriter {
+	dw := &digestWriter{
+		w: w,
+
+		algs:   algs,
+		hashes: make([]hash.Hash, len(algs)),
+	}
+
+	for i, alg := range algs {
+		dw.hashes[i] = alg.new()
+	}
+
+	return dw
+}
+
+func (dw *digestWriter) Write(p []byte) (int, error) {
+	n, err := dw.w.Write(p)
+
+	for _, h := range dw.hashes {
+		// hash.Hash never returns an error.
+		h.Write(p[:n])
+	}
+
+	return n, err
+}
+
+// value formats the digests as an RFC 8941 dictionary with
+// byte sequence members, i.e. sha-256=:base64:.
+func (dw *digestWriter) value() string {
+	var buf bytes.Buffer
+
+	for i, h := range dw.hashes {
+		if i != 0 {
+			buf.WriteString(", ")
+		}
+
+		buf.WriteString(dw.algs[i].key())
+		buf.WriteString("=:")
+		buf.WriteString(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		buf.WriteByte(':')
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,76 @@
+package gziphandler
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256Field(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func sha512Field(b []byte) string {
+	sum := sha512.Sum512(b)
+	return "sha-512=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func newDigestTestHandler(opts ...Option) http.Handler {
+	return Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Repr-Digest", sha256Field([]byte(testBody)))
+		io.WriteString(w, testBody)
+	}), opts...)
+}
+
+func TestDigest(t *testing.T) {
+	handler := newDigestTestHandler(Digest(SHA256, SHA512))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	res := resp.Result()
+	body := resp.Body.Bytes()
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), body)
+	assert.Equal(t, []string{"Content-Digest", "Repr-Digest"}, res.Header["Trailer"])
+
+	expect := sha256Field(body) + ", " + sha512Field(body)
+	assert.Equal(t, expect, res.Trailer.Get("Content-Digest"))
+	assert.Equal(t, expect, res.Trailer.Get("Repr-Digest"))
+}
+
+func TestDigestRemovesMismatched(t *testing.T) {
+	handler := newDigestTestHandler()
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	res := resp.Result()
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header.Get("Repr-Digest"))
+	assert.Equal(t, "", res.Trailer.Get("Repr-Digest"))
+}
+
+func TestDigestUncompressed(t *testing.T) {
+	handler := newDigestTestHandler(Digest(SHA256))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	res := resp.Result()
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, sha256Field([]byte(testBody)), res.Header.Get("Repr-Digest"))
+	assert.Empty(t, res.Trailer)
+}
@@ -0,0 +1,93 @@
+package gziphandler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/tmthrgd/httputils"
+)
+
+// ResponseError describes an error encountered while
+// writing a response. It is passed to the function given to
+// ErrorHandler.
+type ResponseError struct {
+	// Op is the operation that failed: "write", "flush",
+	// "close" or "decide", for an invalid Decision from a
+	// ShouldCompressResponse function.
+	Op string
+
+	// Compressed is true if the response was being
+	// gzipped when the error occurred.
+	Compressed bool
+
+	// Level is the compression level chosen for the
+	// response.
+	Level int
+
+	// BytesWritten is the number of bytes the wrapped
+	// handler had written to the response, before
+	// compression.
+	BytesWritten int64
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ResponseError) Error() string {
+	return "gziphandler: error during " + e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// reportError passes err to the ErrorHandler, if there is
+// one, or logs it otherwise. Errors caused by the client
+// going away are not logged.
+func (w *responseWriter) reportError(op string, err error) {
+	re := &ResponseError{
+		Op:           op,
+		Compressed:   w.compressed,
+		Level:        w.level,
+		BytesWritten: w.written,
+		Err:          err,
+	}
+
+	if fn := w.c.errorHandler; fn != nil {
+		fn(w.r, re)
+		return
+	}
+
+	if !isDisconnect(w.r, err) {
+		httputils.RequestLogf(w.r, "%v", re)
+	}
+}
+
+// isDisconnect reports whether err is expected because the
+// client went away, such as a broken pipe or a connection
+// reset.
+func isDisconnect(r *http.Request, err error) bool {
+	return isConnError(err) ||
+		unwrapErr(err) == context.Canceled ||
+		r.Context().Err() == context.Canceled
+}
+
+// unwrapErr returns the error underlying err if it was
+// returned by a net.Conn or wrapped with Unwrap.
+func unwrapErr(err error) error {
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !plan9
+// +build !plan9
+
+package gziphandler
+
+import "syscall"
+
+// isConnError reports whether err is a broken pipe or a
+// connection reset.
+func isConnError(err error) bool {
+	err = unwrapErr(err)
+	return err == syscall.EPIPE || err == syscall.ECONNRESET
+}
@@ -0,0 +1,15 @@
+//go:build plan9
+// +build plan9
+
+package gziphandler
+
+import "strings"
+
+// isConnError reports whether err is a broken pipe or a
+// connection reset. Plan 9 reports errors as strings.
+func isConnError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "i/o on hungup channel") ||
+		strings.Contains(msg, "connection reset") ||
+		strings.Contains(msg, "write to hungup channel")
+}
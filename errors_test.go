@@ -0,0 +1,234 @@
+package gziphandler
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// errorRecorder is an httptest.ResponseRecorder whose
+// writes fail with err.
+type errorRecorder struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (w errorRecorder) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestErrorHandler(t *testing.T) {
+	writeErr := errors.New("write failed")
+
+	for _, tc := range []struct {
+		op            string
+		flush         bool
+		maxBufferSize int
+		written       int64
+	}{
+		{"write", false, 0, 0},
+		{"flush", true, 4096, int64(len(testBody))},
+		{"close", false, 4096, int64(len(testBody))},
+	} {
+		var reported []*ResponseError
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+
+			if tc.flush {
+				w.(http.Flusher).Flush()
+			}
+		}), CompressionLevel(BestSpeed), MaxBufferSize(tc.maxBufferSize),
+			ErrorHandler(func(r *http.Request, err *ResponseError) {
+				assert.Equal(t, "/whatever", r.URL.Path)
+				reported = append(reported, err)
+			}))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(errorRecorder{httptest.NewRecorder(), writeErr}, req)
+
+		require.Len(t, reported, 1, tc.op)
+
+		err := reported[0]
+		assert.Equal(t, tc.op, err.Op)
+		assert.True(t, err.Compressed, tc.op)
+		assert.Equal(t, BestSpeed, err.Level, tc.op)
+		assert.Equal(t, tc.written, err.BytesWritten, tc.op)
+		assert.Equal(t, writeErr, err.Err, tc.op)
+		assert.Equal(t, "gziphandler: error during "+tc.op+": write failed", err.Error())
+	}
+}
+
+func TestErrorHandlerWrite(t *testing.T) {
+	writeErr := errors.New("write failed")
+
+	var reported []*ResponseError
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, testBody)
+		assert.Equal(t, writeErr, err)
+	}), ContentTypes([]string{"image/png"}), ErrorHandler(func(r *http.Request, err *ResponseError) {
+		reported = append(reported, err)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(errorRecorder{httptest.NewRecorder(), writeErr}, req)
+
+	require.Len(t, reported, 1)
+	assert.Equal(t, "write", reported[0].Op)
+	assert.False(t, reported[0].Compressed)
+	assert.Equal(t, int64(0), reported[0].BytesWritten)
+}
+
+func TestIsDisconnect(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+
+	for _, err := range []error{
+		syscall.EPIPE,
+		syscall.ECONNRESET,
+		&os.SyscallError{Syscall: "write", Err: syscall.EPIPE},
+		&net.OpError{Op: "write", Net: "tcp", Err: &os.SyscallError{Syscall: "write", Err: syscall.ECONNRESET}},
+	} {
+		assert.True(t, isDisconnect(req, err), "%v", err)
+	}
+
+	assert.False(t, isDisconnect(req, errors.New("write failed")))
+
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	assert.True(t, isDisconnect(req.WithContext(ctx), errors.New("write failed")))
+
+	ctx, cancel = context.WithDeadline(req.Context(), time.Now())
+	defer cancel()
+	assert.False(t, isDisconnect(req.WithContext(ctx), errors.New("write failed")))
+	assert.False(t, isDisconnect(req, context.DeadlineExceeded))
+}
+
+// countingRecorder is an httptest.ResponseRecorder that
+// counts calls to Write and fails them with err.
+type countingRecorder struct {
+	*httptest.ResponseRecorder
+	err    error
+	writes int
+}
+
+func (w *countingRecorder) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, w.err
+}
+
+func TestClientGone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var reported []*ResponseError
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, testBody)
+		require.NoError(t, err)
+		w.(http.Flusher).Flush()
+
+		cancel()
+
+		for i := 0; i < 3; i++ {
+			_, err = io.WriteString(w, testBody)
+			assert.Equal(t, context.Canceled, err)
+		}
+
+		rw := w.(*responseWriter)
+		assert.Nil(t, rw.gw, "gzip writer should be released")
+		assert.Nil(t, rw.buf, "buffer should be released")
+	}), ErrorHandler(func(r *http.Request, err *ResponseError) {
+		reported = append(reported, err)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil).WithContext(ctx)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	require.Len(t, reported, 1)
+	assert.Equal(t, "write", reported[0].Op)
+	assert.Equal(t, context.Canceled, reported[0].Err)
+	assert.Equal(t, int64(len(testBody)), reported[0].BytesWritten)
+
+	// Only the flushed part of the response was sent, the
+	// gzip stream was never finished.
+	_, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	assert.NotEqual(t, gzipStrLevel(testBody, DefaultCompression), resp.Body.Bytes())
+}
+
+func TestClientGoneBeforeClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+		cancel()
+	}), MaxBufferSize(4096))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil).WithContext(ctx)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	// The buffered response is still sent.
+	assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), resp.Body.Bytes())
+}
+
+func TestClientTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	var reported []*ResponseError
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+
+		w.WriteHeader(http.StatusGatewayTimeout)
+		_, err := io.WriteString(w, "timeout")
+		assert.NoError(t, err)
+	}), ErrorHandler(func(r *http.Request, err *ResponseError) {
+		reported = append(reported, err)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil).WithContext(ctx)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, resp.Code)
+	assert.Equal(t, "timeout", resp.Body.String())
+	assert.Empty(t, reported)
+}
+
+func TestWriteErrorSticky(t *testing.T) {
+	writeErr := errors.New("write failed")
+	rec := &countingRecorder{ResponseRecorder: httptest.NewRecorder(), err: writeErr}
+
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			_, err := io.WriteString(w, testBody)
+			assert.Equal(t, writeErr, err)
+		}
+
+		w.(http.Flusher).Flush()
+	}), MinSize(0))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, 1, rec.writes)
+}
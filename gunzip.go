@@ -0,0 +1,303 @@
+package gziphandler
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tmthrgd/httputils"
+)
+
+// ErrGunzipTooLarge is reported when a gzipped response
+// decompresses to more than the size limit given to Gunzip.
+// The response is aborted at the limit.
+var ErrGunzipTooLarge = errors.New("gziphandler: gunzipped response exceeds size limit")
+
+var gzipReaderPool sync.Pool
+
+// gunzipWriter decompresses everything written to it into
+// the underlying http.ResponseWriter. gzip.Reader can only
+// pull its input, so the decompression happens in its own
+// goroutine, reading from a pipe.
+type gunzipWriter struct {
+	pw *io.PipeWriter
+
+	// Serializes writes to, and flushes of, the
+	// underlying http.ResponseWriter.
+	mu sync.Mutex
+	w  http.ResponseWriter
+
+	// Also guarded by mu, and broadcast on drained as
+	// they change. sent is the number of bytes written
+	// to pw and read the number the goroutine has read
+	// from it. idle is set while the goroutine is waiting
+	// for more input, and finished once it's returned.
+	drained  *sync.Cond
+	sent     int64
+	read     int64
+	idle     bool
+	finished bool
+
+	// Closed once the goroutine has returned, after
+	// which err holds its error.
+	done chan struct{}
+	err  error
+}
+
+func newGunzipWriter(w http.ResponseWriter, maxSize int64) *gunzipWriter {
+	pr, pw := io.Pipe()
+
+	gw := &gunzipWriter{
+		pw: pw,
+		w:  w,
+
+		done: make(chan struct{}),
+	}
+	gw.drained = sync.NewCond(&gw.mu)
+
+	go gw.run(pr, maxSize)
+	return gw
+}
+
+func (gw *gunzipWriter) run(pr *io.PipeReader, maxSize int64) {
+	defer close(gw.done)
+
+	gw.err = gw.gunzip(gunzipInput{gw, pr}, maxSize)
+
+	// Unblock, and fail, any further writes.
+	pr.CloseWithError(gw.err)
+
+	gw.mu.Lock()
+	gw.finished = true
+	gw.drained.Broadcast()
+	gw.mu.Unlock()
+}
+
+// gunzipInput records the goroutine's progress through the
+// gzipped response, so that Flush can wait for it.
+type gunzipInput struct {
+	gw *gunzipWriter
+	r  io.Reader
+}
+
+func (in gunzipInput) Read(p []byte) (int, error) {
+	gw := in.gw
+
+	gw.mu.Lock()
+	gw.idle = true
+	gw.drained.Broadcast()
+	gw.mu.Unlock()
+
+	n, err := in.r.Read(p)
+
+	gw.mu.Lock()
+	gw.idle = false
+	gw.read += int64(n)
+	gw.mu.Unlock()
+
+	return n, err
+}
+
+func (gw *gunzipWriter) gunzip(r io.Reader, maxSize int64) error {
+	zr, _ := gzipReaderPool.Get().(*gzip.Reader)
+	if zr == nil {
+		zr = new(gzip.Reader)
+	}
+	defer gzipReaderPool.Put(zr)
+
+	switch err := zr.Reset(r); err {
+	case nil:
+	// An empty body, such as the response to a HEAD
+	// request, has nothing to decompress.
+	case io.EOF:
+		return nil
+	default:
+		return err
+	}
+
+	n, err := io.Copy(gw, io.LimitReader(zr, maxSize))
+	if err != nil || n < maxSize {
+		return err
+	}
+
+	// Check whether there's anything beyond the limit.
+	var extra [1]byte
+	if n, _ := io.ReadFull(zr, extra[:]); n != 0 {
+		return ErrGunzipTooLarge
+	}
+
+	return nil
+}
+
+// write passes gzipped data from the handler to the
+// goroutine.
+func (gw *gunzipWriter) write(p []byte) (int, error) {
+	n, err := gw.pw.Write(p)
+
+	gw.mu.Lock()
+	gw.sent += int64(n)
+	gw.mu.Unlock()
+
+	return n, err
+}
+
+// Write writes decompressed data to the response.
+func (gw *gunzipWriter) Write(p []byte) (int, error) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.w.Write(p)
+}
+
+// Flush waits for everything written so far to be
+// decompressed, as far as the gzip stream allows, and then
+// flushes the underlying http.ResponseWriter if it is an
+// http.Flusher.
+func (gw *gunzipWriter) Flush() {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	// Once the goroutine has read everything that was sent
+	// and is waiting for more, it has written out all it
+	// can.
+	for !gw.finished && !(gw.idle && gw.read == gw.sent) {
+		gw.drained.Wait()
+	}
+
+	if fw, ok := gw.w.(http.Flusher); ok {
+		fw.Flush()
+	}
+}
+
+// close waits for the rest of the response to be
+// decompressed.
+func (gw *gunzipWriter) close() error {
+	gw.pw.Close()
+	<-gw.done
+	return gw.err
+}
+
+// abort stops decompressing the response and waits for the
+// goroutine to return.
+func (gw *gunzipWriter) abort(err error) {
+	gw.pw.CloseWithError(err)
+	<-gw.done
+}
+
+// shouldGunzipRequest reports whether responses to r are
+// decompressed if the handler gzips them. Unlike
+// shouldGzipRequest, it ignores ShouldGzip.
+func (c *config) shouldGunzipRequest(r *http.Request) bool {
+	if c.gunzipMaxSize == 0 ||
+		c.noTransform == RequestNoTransform && hasNoTransform(r.Header) {
+		return false
+	}
+
+	return httputils.Negotiate(r.Header, "Accept-Encoding", "gzip") != "gzip"
+}
+
+// shouldGunzip reports whether the response is gzipped and
+// should be decompressed for a client that doesn't accept
+// gzip. Partial responses are left alone, as a range of the
+// gzipped bytes can't be decompressed.
+func (w *responseWriter) shouldGunzip() bool {
+	if !w.gunzip || w.code == http.StatusPartialContent {
+		return false
+	}
+
+	h := w.Header()
+	if h.Get("Content-Range") != "" {
+		return false
+	}
+
+	codings := contentCodings(h)
+	if len(codings) == 0 {
+		return false
+	}
+
+	last := codings[len(codings)-1]
+	return strings.EqualFold(last, "gzip") || strings.EqualFold(last, "x-gzip")
+}
+
+// startGunzip starts decompressing the response.
+func (w *responseWriter) startGunzip() (err error) {
+	if err := w.setState(stateGunzip); err != nil {
+		return err
+	}
+
+	h := w.Header()
+
+	// Remove the gzip coding, leaving any that were
+	// applied before it.
+	codings := contentCodings(h)
+	if codings = codings[:len(codings)-1]; len(codings) != 0 {
+		h.Set("Content-Encoding", strings.Join(codings, ", "))
+	} else {
+		h.Del("Content-Encoding")
+	}
+
+	// The length isn't known until the response has
+	// been decompressed, and ranges and digests refer to
+	// the gzipped bytes.
+	dropEncodedFields(h)
+
+	// The decompressed response is a different
+	// representation, so it mustn't share an ETag with
+	// the gzipped response.
+	suffixETag(h, "-gunzip")
+
+	// Whether the response is decompressed depends on
+	// Accept-Encoding, even if it wouldn't have been
+	// compressed.
+	addVary(h)
+
+	atomic.AddUint64(&w.stats.uncompressed, 1)
+
+	w.ResponseWriter.WriteHeader(w.code)
+
+	w.gunzipper = newGunzipWriter(w.ResponseWriter, w.c.gunzipMaxSize)
+
+	if buf := *w.buf; len(buf) != 0 {
+		_, err = w.gunzipper.write(buf)
+	}
+
+	if rerr := w.releaseBuffer(); err == nil {
+		err = rerr
+	}
+
+	return err
+}
+
+func (w *responseWriter) closeGunzipped() error {
+	err := w.gunzipper.close()
+	w.gunzipper = nil
+	return err
+}
+
+// dropEncodedFields removes the fields that describe the
+// bytes of an encoding that is being removed or replaced.
+func dropEncodedFields(h http.Header) {
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	for _, field := range digestFields {
+		h.Del(field)
+	}
+}
+
+// suffixETag appends suffix inside the quotes of the
+// ETag in h, or removes the ETag if it's malformed.
+func suffixETag(h http.Header, suffix string) {
+	etag := h.Get("ETag")
+	if etag == "" {
+		return
+	}
+
+	if idx := strings.LastIndexByte(etag, '"'); idx > 0 {
+		h.Set("ETag", etag[:idx]+suffix+etag[idx:])
+	} else {
+		h.Del("ETag")
+	}
+}
@@ -0,0 +1,269 @@
+package gziphandler
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newGunzipTestHandler(t *testing.T, body []byte, opts ...Option) http.Handler {
+	return Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Encoding", "gzip")
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("Accept-Ranges", "bytes")
+		h.Set("ETag", `W/"abc"`)
+
+		// Write in small pieces to exercise streaming.
+		for b := body; len(b) != 0; {
+			n := 7
+			if n > len(b) {
+				n = len(b)
+			}
+
+			_, err := w.Write(b[:n])
+			require.NoError(t, err)
+
+			b = b[n:]
+		}
+	}), opts...)
+}
+
+func TestGunzip(t *testing.T) {
+	body := gzipStrLevel(testBody, BestSpeed)
+	handler := newGunzipTestHandler(t, body, Gunzip(1<<20))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	res := resp.Result()
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header.Get("Content-Length"))
+	assert.Equal(t, "", res.Header.Get("Accept-Ranges"))
+	assert.Equal(t, `W/"abc-gunzip"`, res.Header.Get("ETag"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, testBody, resp.Body.String())
+
+	// Clients that accept gzip get the response as-is.
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	res = resp.Result()
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(body)), res.Header.Get("Content-Length"))
+	assert.Equal(t, `W/"abc"`, res.Header.Get("ETag"))
+	assert.Equal(t, body, resp.Body.Bytes())
+}
+
+func TestGunzipDisabled(t *testing.T) {
+	body := gzipStrLevel(testBody, BestSpeed)
+	handler := newGunzipTestHandler(t, body)
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, "gzip", resp.Result().Header.Get("Content-Encoding"))
+	assert.Equal(t, body, resp.Body.Bytes())
+}
+
+func TestGunzipSkipGzip(t *testing.T) {
+	body := gzipStrLevel(testBody, BestSpeed)
+
+	for _, opts := range [][]Option{
+		{Gunzip(1 << 20), ShouldGzip(skipGzip)},
+		append(FromConfig(Config{ExcludePaths: []string{"/"}}), Gunzip(1<<20)),
+	} {
+		handler := newGunzipTestHandler(t, body, opts...)
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+		assert.Equal(t, testBody, resp.Body.String())
+	}
+
+	// RequestNoTransform leaves the response alone.
+	handler := newGunzipTestHandler(t, body, Gunzip(1<<20), NoTransform(RequestNoTransform))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Cache-Control", "no-transform")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, "gzip", resp.Result().Header.Get("Content-Encoding"))
+	assert.Equal(t, body, resp.Body.Bytes())
+}
+
+func TestGunzipStacked(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "x-custom, gzip")
+		w.Header().Set("ETag", `"abc"`)
+		w.Write(gzipStrLevel(testBody, BestSpeed))
+	}), Gunzip(1<<20), PreciseVary(true))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "x-custom")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	res := resp.Result()
+	assert.Equal(t, "x-custom", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"abc-gunzip"`, res.Header.Get("ETag"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, testBody, resp.Body.String())
+}
+
+func TestGunzipTooLarge(t *testing.T) {
+	var writeErr error
+	var reported []*ResponseError
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+
+		// The limit may only be noticed by a later
+		// write, once the gunzipped data has been read.
+		body := gzipStrLevel(testBody, BestSpeed)
+		for i := 0; i < 10 && writeErr == nil; i++ {
+			_, writeErr = w.Write(body)
+		}
+	}), Gunzip(100), ErrorHandler(func(r *http.Request, err *ResponseError) {
+		reported = append(reported, err)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	resp := httptest.NewRecorder()
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(resp, req)
+	})
+
+	assert.Equal(t, ErrGunzipTooLarge, writeErr)
+	assert.Equal(t, testBody[:100], resp.Body.String())
+
+	require.Len(t, reported, 1)
+	assert.Equal(t, ErrGunzipTooLarge, reported[0].Err)
+}
+
+func TestGunzipCorrupt(t *testing.T) {
+	var reported []*ResponseError
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+
+		body := gzipStrLevel(testBody, BestSpeed)
+		w.Write(body[:len(body)/2])
+	}), Gunzip(1<<20), ErrorHandler(func(r *http.Request, err *ResponseError) {
+		reported = append(reported, err)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	})
+
+	require.Len(t, reported, 1)
+	assert.Equal(t, "close", reported[0].Op)
+	assert.Equal(t, io.ErrUnexpectedEOF, reported[0].Err)
+}
+
+// flushRecorder records the body as of each call to Flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (w *flushRecorder) Flush() {
+	w.flushed = append(w.flushed, w.Body.String())
+	w.ResponseRecorder.Flush()
+}
+
+func TestGunzipFlush(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, testBody[:100])
+		require.NoError(t, zw.Flush())
+		w.(http.Flusher).Flush()
+
+		io.WriteString(zw, testBody[100:])
+		require.NoError(t, zw.Close())
+	}), Gunzip(1<<20))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	resp := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, []string{testBody[:100]}, resp.flushed)
+	assert.Equal(t, testBody, resp.Body.String())
+}
+
+func TestGunzipAbortServer(t *testing.T) {
+	srv := httptest.NewServer(Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipStrLevel(testBody, BestSpeed))
+	}), Gunzip(100), ErrorHandler(func(*http.Request, *ResponseError) {})))
+	defer srv.Close()
+
+	// Don't let the client ask for, and transparently
+	// decompress, gzip itself.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	// Depending on whether the headers were flushed before
+	// the response was aborted, either the request or the
+	// read of the body fails.
+	res, err := client.Get(srv.URL)
+	if err == nil {
+		defer res.Body.Close()
+		_, err = ioutil.ReadAll(res.Body)
+	}
+
+	assert.Error(t, err, "the truncated response must not look complete")
+}
+
+func TestGunzipEmpty(t *testing.T) {
+	var reported []*ResponseError
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", "42")
+	}), Gunzip(1<<20), ErrorHandler(func(r *http.Request, err *ResponseError) {
+		reported = append(reported, err)
+	}))
+
+	req := httptest.NewRequest(http.MethodHead, "/whatever", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Empty(t, reported)
+	assert.Equal(t, "", resp.Result().Header.Get("Content-Encoding"))
+	assert.Equal(t, "", resp.Result().Header.Get("Content-Length"))
+}
+
+func TestGunzipPartialContent(t *testing.T) {
+	body := gzipStrLevel(testBody, BestSpeed)[:50]
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Range", "bytes 0-49/*")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body)
+	}), Gunzip(1<<20))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusPartialContent, resp.Code)
+	assert.Equal(t, "gzip", resp.Result().Header.Get("Content-Encoding"))
+	assert.Equal(t, body, resp.Body.Bytes())
+}
@@ -5,11 +5,19 @@ package gziphandler
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/tmthrgd/httputils"
 )
@@ -95,85 +103,376 @@ const (
 type responseWriter struct {
 	http.ResponseWriter
 
-	h *handler
+	c *config
+	r *http.Request
+
+	// The counters of the Handler serving r.
+	stats *counters
+
+	// The state of the response. buf is only set while
+	// buffering and gw is only set while gzipping.
+	state state
 
 	gw *gzip.Writer
 
+	// Hashes the compressed body if digests were
+	// requested.
+	digest *digestWriter
+
 	// Holds the first part of the write before reaching
 	// the minSize or the end of the write.
 	buf *[]byte
 
 	// Saves the WriteHeader value.
 	code int
+
+	// The compression level for this response.
+	level int
+
+	// Whether the response is being gzipped.
+	compressed bool
+
+	// The number of bytes written by the handler.
+	written int64
+
+	// The error that abandoned the response, if it was
+	// closed early.
+	err error
+
+	// Whether the response was abandoned part way
+	// through, and the connection must be aborted so the
+	// client doesn't mistake it for a complete response.
+	aborted bool
+
+	// Whether Vary should be set as the response commits
+	// to being compressed, see PreciseVary.
+	vary bool
+
+	// Whether the response must not be compressed as the
+	// client doesn't accept gzip. It's only inspected to
+	// set Vary, or to be decompressed.
+	identity bool
+
+	// Whether a gzipped response should be decompressed
+	// by gunzipper, see Gunzip.
+	gunzip    bool
+	gunzipper *gunzipWriter
 }
 
 // WriteHeader just saves the response code until close or
 // GZIP effective writes.
+//
+// Responses with a status code that shouldn't be compressed
+// are passed through immediately.
+//
+// Informational (1xx) responses, such as 103 Early Hints,
+// are forwarded straight to the underlying
+// http.ResponseWriter and don't affect the final response.
 func (w *responseWriter) WriteHeader(code int) {
-	if w.code == 0 {
-		w.code = code
+	if isInformational(code) {
+		if w.code == 0 {
+			w.ResponseWriter.WriteHeader(code)
+		}
+
+		return
+	}
+
+	if w.code != 0 || w.state == stateHijacked || w.state == stateClosed {
+		return
+	}
+
+	w.code = code
+
+	if w.state == stateBuffering && !w.handleStatusCode() {
+		// The buffer is always empty here as Write
+		// calls WriteHeader before buffering, so
+		// startPassThrough cannot fail.
+		w.startPassThrough()
 	}
 }
 
+// isInformational reports whether code is a 1xx status code
+// that precedes the final response. 101 Switching Protocols
+// is the final response for the current protocol.
+func isInformational(code int) bool {
+	return code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols
+}
+
 // Write appends data to the gzip writer.
 func (w *responseWriter) Write(b []byte) (int, error) {
-	switch {
-	case w.buf != nil && w.gw != nil:
-		panic("gziphandler: both buf and gw are non nil in call to Write")
-	// GZIP responseWriter is initialized. Use the GZIP
-	// responseWriter.
-	case w.gw != nil:
-		return w.gw.Write(b)
-	// We're operating in pass through mode.
-	case w.buf == nil:
+	switch w.state {
+	case stateHijacked:
+		return 0, http.ErrHijacked
+	case stateClosed:
+		if w.err != nil {
+			return 0, w.err
+		}
+
+		return 0, ErrClosed
+	}
+
+	if err := w.checkState("Write"); err != nil {
+		w.reportError("write", err)
+		return 0, err
+	}
+
+	n, err := w.write(b)
+	w.written += int64(n)
+
+	if err != nil {
+		w.fail(err)
+		w.reportError("write", err)
+	}
+
+	return n, err
+}
+
+// fail abandons the response after err, which is returned
+// by later calls to Write. The gzip writer and buffer are
+// released immediately, rather than when the handler
+// returns, so no more compression work is done.
+func (w *responseWriter) fail(err error) {
+	// The headers of a gunzipped response have already
+	// been sent without a Content-Length, so ending it
+	// cleanly would make the truncated body look complete.
+	if w.state == stateGunzip {
+		w.aborted = true
+	}
+
+	w.err = err
+	w.release()
+	w.state = stateClosed
+}
+
+// release returns the gzip writer and buffer to their pools
+// without finishing the response.
+func (w *responseWriter) release() {
+	if w.gw != nil {
+		gzipWriterPut(w.gw, w.level)
+		w.gw = nil
+	}
+
+	if w.buf != nil {
+		w.releaseBuffer()
+	}
+
+	if w.gunzipper != nil {
+		w.gunzipper.abort(http.ErrAbortHandler)
+		w.gunzipper = nil
+	}
+
+	w.digest = nil
+}
+
+// clientGone returns context.Canceled once the client has
+// gone away. A context that merely passed its deadline,
+// perhaps set by a timeout middleware, doesn't count; the
+// handler may still be writing a response about that.
+func (w *responseWriter) clientGone() error {
+	if err := w.r.Context().Err(); err == context.Canceled {
+		return err
+	}
+
+	return nil
+}
+
+func (w *responseWriter) write(b []byte) (int, error) {
+	switch w.state {
+	case stateGzip:
+		if err := w.clientGone(); err != nil {
+			return 0, err
+		}
+
+		return w.writeGzip(b)
+	case stateGunzip:
+		if err := w.clientGone(); err != nil {
+			return 0, err
+		}
+
+		return w.gunzipper.write(b)
+	case statePassThrough:
 		return w.ResponseWriter.Write(b)
 	}
 
 	w.WriteHeader(http.StatusOK)
 
+	// WriteHeader may have started pass through mode.
+	if w.state == statePassThrough {
+		return w.ResponseWriter.Write(b)
+	}
+
 	// This may succeed if the Content-Type header was
 	// explicitly set.
-	if w.shouldPassThrough() {
-		if err := w.startPassThrough(); err != nil {
-			return 0, err
+	if !w.shouldPassThrough() {
+		if w.shouldBuffer(b) {
+			// Save the write into a buffer for later.
+			// This buffer will be flushed in either
+			// startGzip or startPassThrough.
+			*w.buf = append(*w.buf, b...)
+			return len(b), nil
 		}
 
-		return w.ResponseWriter.Write(b)
+		w.inferContentType(b)
+
+		// The inferred Content-Type may have a larger
+		// minimum size.
+		if !w.shouldPassThrough() && w.shouldBuffer(b) {
+			*w.buf = append(*w.buf, b...)
+			return len(b), nil
+		}
+	}
+
+	if err := w.start(b); err != nil {
+		return 0, err
+	}
+
+	switch w.state {
+	case stateGzip:
+		return w.writeGzip(b)
+	case stateGunzip:
+		return w.gunzipper.write(b)
 	}
 
-	if w.shouldBuffer(b) {
-		// Save the write into a buffer for later.
-		// This buffer will be flushed in either
-		// startGzip or startPassThrough.
-		*w.buf = append(*w.buf, b...)
-		return len(b), nil
+	return w.ResponseWriter.Write(b)
+}
+
+// writeGzip writes b to the gzip writer and counts it.
+func (w *responseWriter) writeGzip(b []byte) (int, error) {
+	n, err := w.gw.Write(b)
+	atomic.AddUint64(&w.stats.bytesIn, uint64(n))
+	return n, err
+}
+
+// start calls either startGzip or startPassThrough once
+// we've stopped buffering. b is the pending write, if any.
+func (w *responseWriter) start(b []byte) error {
+	if w.shouldGunzip() {
+		return w.startGunzip()
+	}
+
+	if w.identity {
+		typ := SkipGzip
+		if w.vary {
+			typ = w.decide(b, true)
+		}
+
+		return w.startIdentity(typ)
+	}
+
+	switch w.decide(b, true) {
+	case NegotiateGzip:
+		if !w.compressionPays(b) {
+			return w.startPassThrough()
+		}
+
+		return w.startGzip()
+	case ForceGzip:
+		return w.startGzip()
+	default:
+		return w.startPassThrough()
 	}
+}
 
-	w.inferContentType(b)
+// startIdentity sends a response that the client can't
+// accept gzipped as-is. typ is the decision that would have
+// been made had it accepted gzip.
+func (w *responseWriter) startIdentity(typ ShouldGzipType) error {
+	if w.vary && typ != SkipGzip {
+		addVary(w.Header())
+	}
+
+	return w.startPassThrough()
+}
 
+// decide is called as the response commits. ok is false if
+// the response is too small to be compressed. b is the
+// pending write, if any.
+//
+// It returns SkipGzip if the response must not be
+// compressed, ForceGzip if it must be, or NegotiateGzip if
+// it should be compressed provided compression pays off.
+func (w *responseWriter) decide(b []byte, ok bool) ShouldGzipType {
 	// Now that we've called inferContentType, we have
 	// a Content-Type header.
-	if w.shouldPassThrough() {
-		if err := w.startPassThrough(); err != nil {
-			return 0, err
-		}
+	typ := NegotiateGzip
+	if !ok || w.shouldPassThrough() {
+		typ = SkipGzip
+	}
 
-		return w.ResponseWriter.Write(b)
+	// The client doesn't accept gzip, so the answer only
+	// matters to PreciseVary. The user's callbacks are
+	// never called for such clients.
+	if w.identity {
+		return typ
 	}
 
-	if err := w.startGzip(); err != nil {
-		return 0, err
+	if level, ok := w.sizeTierLevel(b); ok {
+		w.level = level
+	}
+
+	if rule := w.contentTypeRule(); rule != nil {
+		w.level = rule.level
+	}
+
+	fn := w.c.shouldCompressResponse
+	if fn == nil {
+		return typ
+	}
+
+	d := fn(w.r, w.code, w.Header(), w.sniffPrefix(b))
+	if d.setLevel {
+		if validLevel(d.level) {
+			w.level = d.level
+		} else {
+			w.reportError("decide", fmt.Errorf("invalid compression level requested: %d", d.level))
+		}
+	}
+
+	switch d.typ {
+	case SkipGzip:
+		return SkipGzip
+	case ForceGzip:
+		// Never compress a response that has
+		// already been encoded.
+		if !w.alreadyEncoded() {
+			return ForceGzip
+		}
 	}
 
-	return w.gw.Write(b)
+	return typ
+}
+
+// setGzipHeaders updates the response headers that
+// describe a gzipped body.
+func (w *responseWriter) setGzipHeaders() {
+	h := w.Header()
+
+	// Set the GZIP header. Any existing codings are only
+	// kept if StackEncodings allowed gzipping on top of
+	// them.
+	codings := append(contentCodings(h), "gzip")
+	h.Set("Content-Encoding", strings.Join(codings, ", "))
+
+	// Any digest set by the handler was computed over
+	// the uncompressed body and no longer matches.
+	for _, field := range digestFields {
+		h.Del(field)
+	}
 }
 
 // startGzip initialize any GZIP specific informations.
 func (w *responseWriter) startGzip() (err error) {
+	if err := w.setState(stateGzip); err != nil {
+		return err
+	}
+
 	h := w.Header()
 
-	// Set the GZIP header.
-	h.Set("Content-Encoding", "gzip")
+	w.setGzipHeaders()
+
+	if w.vary {
+		addVary(h)
+	}
 
 	// if the Content-Length is already set, then calls
 	// to Write on gzip will fail to set the
@@ -181,42 +480,71 @@ func (w *responseWriter) startGzip() (err error) {
 	// See: https://github.com/golang/go/issues/14975.
 	h.Del("Content-Length")
 
+	atomic.AddUint64(&w.stats.compressed, 1)
+	w.compressed = true
+
+	var out io.Writer = statsWriter{w.ResponseWriter, w.stats}
+	if len(w.c.digests) != 0 {
+		// The digests can only be known once the
+		// body has been compressed so they're sent
+		// as trailers.
+		for _, field := range digestFields {
+			h.Add("Trailer", field)
+		}
+
+		w.digest = newDigestWriter(out, w.c.digests)
+		out = w.digest
+	}
+
 	// Write the header to gzip response.
 	w.ResponseWriter.WriteHeader(w.code)
 
 	// Bytes written during ServeHTTP are redirected to
 	// this gzip writer before being written to the
 	// underlying response.
-	w.gw = gzipWriterGet(w.ResponseWriter, w.h.level)
+	w.gw = gzipWriterGet(out, w.level)
 
 	if buf := *w.buf; len(buf) != 0 {
 		// Flush the buffer into the gzip response.
-		_, err = w.gw.Write(buf)
+		_, err = w.writeGzip(buf)
+	}
+
+	if rerr := w.releaseBuffer(); err == nil {
+		err = rerr
 	}
 
-	w.releaseBuffer()
 	return err
 }
 
 func (w *responseWriter) startPassThrough() (err error) {
+	if err := w.setState(statePassThrough); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&w.stats.uncompressed, 1)
+
 	w.ResponseWriter.WriteHeader(w.code)
 
 	if buf := *w.buf; len(buf) != 0 {
 		_, err = w.ResponseWriter.Write(buf)
 	}
 
-	w.releaseBuffer()
+	if rerr := w.releaseBuffer(); err == nil {
+		err = rerr
+	}
+
 	return err
 }
 
-func (w *responseWriter) releaseBuffer() {
+func (w *responseWriter) releaseBuffer() error {
 	if w.buf == nil {
-		panic("gziphandler: w.buf is nil in call to emptyBuffer")
+		return invariantError("w.buf is nil in call to emptyBuffer")
 	}
 
 	*w.buf = (*w.buf)[:0]
 	bufferPool.Put(w.buf)
 	w.buf = nil
+	return nil
 }
 
 func (w *responseWriter) shouldBuffer(b []byte) bool {
@@ -224,7 +552,91 @@ func (w *responseWriter) shouldBuffer(b []byte) bool {
 	// minSize, we no longer need to buffer and we can
 	// decide whether to enable compression or whether
 	// to operate in pass through mode.
-	return len(*w.buf)+len(b) < w.h.minSize
+	//
+	// If maxBufferSize is set, we keep buffering until
+	// we know the response won't fit in the buffer.
+	//
+	// If lookAhead is set, we keep buffering until we
+	// can tell whether compression pays off.
+	n := len(*w.buf) + len(b)
+	if w.identity {
+		// Only PreciseVary needs to know whether the
+		// response would have been compressed.
+		return w.vary && n < w.minSize()
+	}
+
+	return n < w.minSize() || n <= w.c.maxBufferSize || n < w.c.lookAhead
+}
+
+// compressionPays compresses up to lookAhead bytes of the
+// buffered response, followed by b, and reports whether the
+// result is within the configured ratio. If it's not, the
+// fallback is reported.
+func (w *responseWriter) compressionPays(b []byte) bool {
+	if w.c.lookAhead == 0 {
+		return true
+	}
+
+	prefix := *w.buf
+	if len(prefix) > w.c.lookAhead {
+		prefix = prefix[:w.c.lookAhead]
+	}
+
+	if n := w.c.lookAhead - len(prefix); len(b) > n {
+		b = b[:n]
+	}
+
+	var cw countWriter
+	gw := gzipWriterGet(&cw, w.level)
+	gw.Write(prefix)
+	gw.Write(b)
+	gw.Close()
+	gzipWriterPut(gw, w.level)
+
+	return !w.shouldFallback(len(prefix)+len(b), int(cw))
+}
+
+// shouldFallback reports whether a body of size bytes that
+// compressed to compressed bytes should instead be sent
+// uncompressed. If so, the fallback is reported.
+func (w *responseWriter) shouldFallback(size, compressed int) bool {
+	if compressed < size && (w.c.ratio == 0 ||
+		float64(compressed) <= w.c.ratio*float64(size)) {
+		return false
+	}
+
+	if w.c.onFallback != nil {
+		w.c.onFallback(w.r, size, compressed)
+	}
+
+	return true
+}
+
+// countWriter is an io.Writer that discards everything
+// written to it, but counts the number of bytes.
+type countWriter int
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	*cw += countWriter(len(p))
+	return len(p), nil
+}
+
+// sniffPrefix returns the buffered response followed by
+// as much of b as is needed to fill sniffLen bytes.
+func (w *responseWriter) sniffPrefix(b []byte) []byte {
+	buf := *w.buf
+	if len(buf) == 0 {
+		return b
+	}
+
+	const sniffLen = 512
+	if len(buf) >= sniffLen {
+		return buf
+	} else if len(buf)+len(b) > sniffLen {
+		return append(buf, b[:sniffLen-len(buf)]...)
+	} else {
+		return append(buf, b...)
+	}
 }
 
 func (w *responseWriter) inferContentType(b []byte) {
@@ -235,16 +647,7 @@ func (w *responseWriter) inferContentType(b []byte) {
 		return
 	}
 
-	if buf := *w.buf; len(buf) != 0 {
-		const sniffLen = 512
-		if len(buf) >= sniffLen {
-			b = buf
-		} else if len(buf)+len(b) > sniffLen {
-			b = append(buf, b[:sniffLen-len(buf)]...)
-		} else {
-			b = append(buf, b...)
-		}
-	}
+	b = w.sniffPrefix(b)
 
 	if len(b) == 0 {
 		return
@@ -255,23 +658,71 @@ func (w *responseWriter) inferContentType(b []byte) {
 }
 
 func (w *responseWriter) shouldPassThrough() bool {
-	if w.Header().Get("Content-Encoding") != "" {
+	if w.alreadyEncoded() {
+		return true
+	}
+
+	if w.c.noTransform != IgnoreNoTransform && hasNoTransform(w.Header()) {
 		return true
 	}
 
 	return !w.handleContentType()
 }
 
+// alreadyEncoded reports whether the handler has applied a
+// content coding that prevents the response from being
+// gzipped.
+func (w *responseWriter) alreadyEncoded() bool {
+	codings := contentCodings(w.Header())
+	if len(codings) == 0 {
+		return false
+	}
+
+	if !w.c.stackEncodings {
+		return true
+	}
+
+	// There's nothing to gain from gzipping twice.
+	for _, coding := range codings {
+		if strings.EqualFold(coding, "gzip") || strings.EqualFold(coding, "x-gzip") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contentCodings returns the content codings listed in the
+// Content-Encoding header in the order they were applied.
+// identity is omitted as it means no coding.
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, v := range h["Content-Encoding"] {
+		for _, coding := range strings.Split(v, ",") {
+			coding = strings.TrimSpace(coding)
+			if coding != "" && !strings.EqualFold(coding, "identity") {
+				codings = append(codings, coding)
+			}
+		}
+	}
+
+	return codings
+}
+
 func (w *responseWriter) handleContentType() bool {
-	// If contentTypes is empty, accept any content
-	// type.
-	if len(w.h.contentTypes) == 0 {
+	return w.c.handlesContentType(w.Header())
+}
+
+func (c *config) handlesContentType(h http.Header) bool {
+	// If contentTypes and excludeContentTypes are empty,
+	// accept any content type.
+	if len(c.contentTypes) == 0 && len(c.excludeContentTypes) == 0 {
 		return true
 	}
 
 	// If the Content-Type header is not set, return
 	// as we haven't called inferContentType yet.
-	ct, ok := w.Header()["Content-Type"]
+	ct, ok := h["Content-Type"]
 	if !ok {
 		return true
 	}
@@ -280,52 +731,307 @@ func (w *responseWriter) handleContentType() bool {
 		return false
 	}
 
-	return httputils.MIMETypeMatches(ct[0], w.h.contentTypes)
+	if len(c.excludeContentTypes) != 0 &&
+		httputils.MIMETypeMatches(ct[0], c.excludeContentTypes) {
+		return false
+	}
+
+	return len(c.contentTypes) == 0 ||
+		httputils.MIMETypeMatches(ct[0], c.contentTypes)
+}
+
+// contentTypeRule returns the first rule given to
+// PerContentType that matches the Content-Type header, or
+// nil if none do.
+func (w *responseWriter) contentTypeRule() *contentTypeRule {
+	return w.c.contentTypeRuleFor(w.Header())
+}
+
+func (c *config) contentTypeRuleFor(h http.Header) *contentTypeRule {
+	if len(c.contentTypeRules) == 0 {
+		return nil
+	}
+
+	ct, ok := h["Content-Type"]
+	if !ok || len(ct) == 0 {
+		return nil
+	}
+
+	for i := range c.contentTypeRules {
+		rule := &c.contentTypeRules[i]
+		if httputils.MIMETypeMatches(ct[0], rule.types) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// sizeTierLevel returns the compression level of the
+// largest tier given to SizeTiers that the response reaches.
+// The declared Content-Length is used if there is one,
+// otherwise the size of the buffered response and b.
+func (w *responseWriter) sizeTierLevel(b []byte) (int, bool) {
+	if len(w.c.sizeTiers) == 0 {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		size = int64(len(*w.buf) + len(b))
+	}
+
+	return w.c.sizeTierLevel(size)
+}
+
+func (c *config) sizeTierLevel(size int64) (int, bool) {
+	// sizeTiers is sorted by size.
+	level, ok := 0, false
+	for _, tier := range c.sizeTiers {
+		if size < int64(tier.Size) {
+			break
+		}
+
+		level, ok = tier.Level, true
+	}
+
+	return level, ok
+}
+
+// minSize returns the minimum size of a response before it
+// will be compressed, taking PerContentType into account.
+func (w *responseWriter) minSize() int {
+	if rule := w.contentTypeRule(); rule != nil {
+		return rule.minSize
+	}
+
+	return w.c.minSize
+}
+
+func (w *responseWriter) handleStatusCode() bool {
+	return w.c.handlesStatusCode(w.code)
+}
+
+func (c *config) handlesStatusCode(code int) bool {
+	// If statusCodes is empty, accept any status code.
+	if len(c.statusCodes) == 0 {
+		return true
+	}
+
+	for _, r := range c.statusCodes {
+		if code >= r.Min && code <= r.Max {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Close will close the gzip.Writer and will put it back in
 // the gzipWriterPool.
 func (w *responseWriter) Close() error {
-	switch {
-	case w.buf != nil && w.gw != nil:
-		panic("gziphandler: both buf and gw are non nil in call to Close")
-	// Buffer not nil means the regular response must
-	// be returned.
-	case w.buf != nil:
-		return w.closeNonGzipped()
-	// If the GZIP responseWriter is not set no need
-	// to close it.
-	case w.gw != nil:
-		return w.closeGzipped()
-	// Both buf and gw nil means we are operating in
-	// pass through mode.
-	default:
+	if err := w.checkState("Close"); err != nil {
+		// Leave the pooled resources alone, they
+		// can't be trusted.
+		w.err = err
+		w.state = stateClosed
+		return err
+	}
+
+	var err error
+	switch w.state {
+	// The response was already closed, or abandoned
+	// and the error has already been reported.
+	case stateClosed:
 		return nil
+	// Nothing has been buffered or compressed.
+	case statePassThrough, stateHijacked:
+	// The buffered status and body are always sent, even
+	// if the client went away; it costs little and the
+	// write will fail if the connection really is gone.
+	case stateBuffering:
+		err = w.closeNonGzipped()
+	// The client went away before the response was
+	// finished, there's no point compressing the rest.
+	case stateGzip, stateGunzip:
+		if err = w.clientGone(); err != nil {
+			break
+		}
+
+		if w.state == stateGzip {
+			err = w.closeGzipped()
+		} else {
+			err = w.closeGunzipped()
+		}
 	}
+
+	if err != nil {
+		w.fail(err)
+		return err
+	}
+
+	w.release()
+	w.state = stateClosed
+	return nil
 }
 
 func (w *responseWriter) closeGzipped() error {
 	err := w.gw.Close()
 
-	gzipWriterPut(w.gw, w.h.level)
+	gzipWriterPut(w.gw, w.level)
 	w.gw = nil
 
+	if w.digest != nil {
+		value := w.digest.value()
+		w.digest = nil
+
+		h := w.Header()
+		for _, field := range digestFields {
+			h.Set(field, value)
+		}
+	}
+
 	return err
 }
 
 func (w *responseWriter) closeNonGzipped() error {
 	w.inferContentType(nil)
 
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(http.StatusOK)
+
+	// WriteHeader may have started pass through mode.
+	if w.state == statePassThrough {
+		return nil
+	}
+
+	if w.shouldGunzip() {
+		if err := w.startGunzip(); err != nil {
+			return err
+		}
+
+		return w.closeGunzipped()
+	}
+
+	typ := SkipGzip
+	if buf := *w.buf; len(buf) != 0 {
+		typ = w.decide(nil, len(buf) >= w.minSize())
+	}
+
+	if w.identity {
+		return w.startIdentity(typ)
+	}
+
+	switch {
+	case typ == SkipGzip:
+		return w.startPassThrough()
+	// The whole response fit within maxBufferSize.
+	case len(*w.buf) <= w.c.maxBufferSize:
+		return w.closeBuffered(typ == ForceGzip)
+	// We're only buffering because of lookAhead.
+	case typ == NegotiateGzip && !w.compressionPays(nil):
+		return w.startPassThrough()
+	}
+
+	if err := w.startGzip(); err != nil {
+		return err
+	}
+
+	return w.closeGzipped()
+}
+
+// closeBuffered compresses the buffered response in memory
+// so that it can be sent with an exact Content-Length. If
+// compression doesn't reduce the size of the response, the
+// uncompressed body is sent instead, unless force is true.
+func (w *responseWriter) closeBuffered(force bool) error {
+	buf := *w.buf
+
+	out := bufferPool.Get().(*[]byte)
+	defer func() {
+		*out = (*out)[:0]
+		bufferPool.Put(out)
+	}()
+
+	bb := bytes.NewBuffer(*out)
+
+	var dw *digestWriter
+	var dst io.Writer = bb
+	if len(w.c.digests) != 0 {
+		dw = newDigestWriter(dst, w.c.digests)
+		dst = dw
+	}
+
+	gw := gzipWriterGet(dst, w.level)
+	gw.Write(buf)
+	err := gw.Close()
+	gzipWriterPut(gw, w.level)
+
+	*out = bb.Bytes()
+	if err != nil {
+		return err
+	}
+
+	h := w.Header()
+
+	if !force && w.shouldFallback(len(buf), len(*out)) {
+		h.Set("Content-Length", strconv.Itoa(len(buf)))
+		return w.startPassThrough()
+	}
+
+	if err := w.setState(stateGzip); err != nil {
+		return err
+	}
+
+	w.setGzipHeaders()
+	h.Set("Content-Length", strconv.Itoa(len(*out)))
+
+	if w.vary {
+		addVary(h)
+	}
+
+	atomic.AddUint64(&w.stats.compressed, 1)
+	atomic.AddUint64(&w.stats.bytesIn, uint64(len(buf)))
+	w.compressed = true
+
+	if dw != nil {
+		value := dw.value()
+		for _, field := range digestFields {
+			h.Set(field, value)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.code)
+
+	_, err = statsWriter{w.ResponseWriter, w.stats}.Write(*out)
 
-	return w.startPassThrough()
+	if rerr := w.releaseBuffer(); err == nil {
+		err = rerr
+	}
+
+	return err
 }
 
 // Flush flushes the underlying *gzip.Writer and then the
 // underlying http.ResponseWriter if it is an http.Flusher.
 // This makes responseWriter an http.Flusher.
 func (w *responseWriter) Flush() {
-	if w.gw == nil && w.buf != nil {
+	switch w.state {
+	case stateHijacked, stateClosed:
+		return
+	}
+
+	if err := w.checkState("Flush"); err != nil {
+		w.reportError("flush", err)
+		return
+	}
+
+	if err := w.clientGone(); err != nil && (w.state == stateGzip || w.state == stateGunzip) {
+		w.fail(err)
+		w.reportError("flush", err)
+		return
+	}
+
+	if w.state == stateBuffering {
 		// Fix for NYTimes/gziphandler#58:
 		//  Only flush once startGzip or
 		//  startPassThrough has been called.
@@ -333,11 +1039,35 @@ func (w *responseWriter) Flush() {
 		// Flush is thus a no-op until the written
 		// body exceeds minSize, or we've decided
 		// not to compress.
-		return
+		if buf := *w.buf; len(buf) == 0 || len(buf) < w.minSize() {
+			return
+		}
+
+		// We're only still buffering because of
+		// maxBufferSize, but the handler wants the
+		// data sent now.
+		w.inferContentType(nil)
+
+		if err := w.start(nil); err != nil {
+			w.fail(err)
+			w.reportError("flush", err)
+			return
+		}
 	}
 
-	if w.gw != nil {
-		w.gw.Flush()
+	if w.state == stateGzip {
+		if err := w.gw.Flush(); err != nil {
+			w.fail(err)
+			w.reportError("flush", err)
+			return
+		}
+	}
+
+	// The gunzip goroutine may be writing to the
+	// underlying response.
+	if w.state == stateGunzip {
+		w.gunzipper.Flush()
+		return
 	}
 
 	if fw, ok := w.ResponseWriter.(http.Flusher); ok {
@@ -345,30 +1075,171 @@ func (w *responseWriter) Flush() {
 	}
 }
 
-type handler struct {
+// Handler wraps an HTTP handler, to transparently gzip the
+// response body if the client supports it (via the
+// Accept-Encoding header).
+//
+// The options a Handler was created with can be replaced
+// while it is serving requests by calling Update.
+//
+// The wrapped handler may hijack the connection, such as
+// to upgrade it to a WebSocket, until part of the response
+// body has been written; after that Hijack returns
+// ErrHijackCommitted. Anything that was only buffered is
+// sent uncompressed before the connection is handed over.
+type Handler struct {
+	// stats is accessed atomically and must be first
+	// to be 64-bit aligned on 32-bit platforms.
+	stats counters
+
 	h http.Handler
+
+	// The current *handlerConfig. It is swapped, never
+	// modified, by Update so responses that are in-flight
+	// keep the config they started with.
+	config atomic.Value
+}
+
+// handlerConfig is a snapshot of the options given to New
+// or Update.
+type handlerConfig struct {
 	config
+
+	// The configs for each of the rules passed to
+	// WithRules, compiled by newHandlerConfig.
+	compiled []compiledRule
+}
+
+func newHandlerConfig(opts []Option) (*handlerConfig, error) {
+	hc := &handlerConfig{
+		config: config{
+			level:   DefaultCompression,
+			minSize: defaultMinSize,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(&hc.config)
+	}
+
+	if err := hc.config.validate(); err != nil {
+		return nil, fmt.Errorf("gziphandler: %v", err)
+	}
+
+	compiled, err := compileRules(&hc.config)
+	if err != nil {
+		return nil, fmt.Errorf("gziphandler: %v", err)
+	}
+
+	hc.compiled = compiled
+	return hc, nil
 }
 
-func (h *handler) shouldGzip(r *http.Request) bool {
-	if h.config.shouldGzip != nil {
-		switch h.config.shouldGzip(r) {
+// configFor returns the config of the first rule that
+// matches r, or the handler's config if none do.
+func (hc *handlerConfig) configFor(r *http.Request) *config {
+	for i := range hc.compiled {
+		if rule := &hc.compiled[i]; rule.match(r) {
+			return &rule.config
+		}
+	}
+
+	return &hc.config
+}
+
+// Update replaces the handler's options with opts. The
+// options are applied to the defaults, not to the options
+// the handler currently has.
+//
+// Responses that are already being served continue to use
+// the options they started with, new requests use opts.
+// Update is safe to call concurrently with ServeHTTP.
+//
+// If any of the options are invalid, Update returns an
+// error and the handler's options are left unchanged.
+func (h *Handler) Update(opts ...Option) error {
+	hc, err := newHandlerConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	h.config.Store(hc)
+	return nil
+}
+
+// shouldGzipRequest reports whether the response to r may
+// be gzipped, and whether that was decided by negotiating
+// the Accept-Encoding header.
+func (c *config) shouldGzipRequest(r *http.Request) (ok, negotiated bool) {
+	if c.noTransform == RequestNoTransform && hasNoTransform(r.Header) {
+		return false, false
+	}
+
+	if c.shouldGzip != nil {
+		switch c.shouldGzip(r) {
 		case NegotiateGzip:
 		case SkipGzip:
-			return false
+			return false, false
 		case ForceGzip:
-			return true
+			return true, false
 		}
 	}
 
 	match := httputils.Negotiate(r.Header, "Accept-Encoding", "gzip")
-	return match == "gzip"
+	return match == "gzip", true
+}
+
+// addVary adds Accept-Encoding to the Vary header, unless
+// it is already listed or the response varies on
+// everything (*).
+func addVary(h http.Header) {
+	for _, v := range h["Vary"] {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// hasNoTransform reports whether the Cache-Control header
+// contains the no-transform directive.
+func hasNoTransform(h http.Header) bool {
+	for _, v := range h["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Vary", "Accept-Encoding")
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&h.stats.requests, 1)
 
-	if !h.shouldGzip(r) {
+	c := h.config.Load().(*handlerConfig).configFor(r)
+
+	if !c.preciseVary {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	ok, negotiated := c.shouldGzipRequest(r)
+	gunzip := !ok && c.shouldGunzipRequest(r)
+
+	// With PreciseVary, responses to clients that don't
+	// accept gzip are still inspected as they commit to
+	// tell whether they would have been compressed. With
+	// Gunzip, they may need decompressing.
+	identity := !ok && (negotiated && c.preciseVary || gunzip)
+
+	if !ok && !identity {
+		atomic.AddUint64(&h.stats.uncompressed, 1)
 		h.h.ServeHTTP(w, r)
 		return
 	}
@@ -376,13 +1247,38 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	gw := &responseWriter{
 		ResponseWriter: w,
 
-		h: h,
+		c: c,
+		r: r,
+
+		stats: &h.stats,
+
+		vary:     negotiated && c.preciseVary,
+		identity: identity,
+		gunzip:   gunzip,
+
+		level: c.level,
 
 		buf: bufferPool.Get().(*[]byte),
 	}
+
+	completed := false
 	defer func() {
+		if !completed {
+			// The handler panicked, possibly with
+			// http.ErrAbortHandler. Finishing the gzip
+			// stream would make the truncated response
+			// look complete, so it's abandoned instead
+			// and the panic continues to unwind.
+			gw.fail(http.ErrAbortHandler)
+			return
+		}
+
 		if err := gw.Close(); err != nil {
-			httputils.RequestLogf(r, "gziphandler: error closing writer: %#v", err)
+			gw.reportError("close", err)
+		}
+
+		if gw.aborted {
+			panic(http.ErrAbortHandler)
 		}
 	}()
 
@@ -406,25 +1302,40 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	h.h.ServeHTTP(rw, r)
+	completed = true
 }
 
 // Gzip wraps an HTTP handler, to transparently gzip the
 // response body if the client supports it (via the
 // the Accept-Encoding header).
+//
+// Gzip panics if any of the options are invalid. Use New
+// to handle the error instead.
 func Gzip(h http.Handler, opts ...Option) http.Handler {
-	gzh := &handler{
-		h: h,
-		config: config{
-			level:   DefaultCompression,
-			minSize: defaultMinSize,
-		},
+	gzh, err := New(h, opts...)
+	if err != nil {
+		panic(err.Error())
 	}
 
-	for _, opt := range opts {
-		opt(&gzh.config)
+	return gzh
+}
+
+// New wraps an HTTP handler, to transparently gzip the
+// response body if the client supports it (via the
+// the Accept-Encoding header).
+//
+// New returns an error if any of the options are invalid
+// or if they contradict each other. The options can later
+// be replaced with the returned Handler's Update method.
+func New(h http.Handler, opts ...Option) (*Handler, error) {
+	hc, err := newHandlerConfig(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	return gzh
+	gzh := &Handler{h: h}
+	gzh.config.Store(hc)
+	return gzh, nil
 }
 
 // Wrapper returns a wrapper function (often known as
@@ -438,13 +1349,35 @@ func Wrapper(opts ...Option) func(http.Handler) http.Handler {
 }
 
 type config struct {
-	level        int
-	minSize      int
-	contentTypes []string
-	shouldGzip   func(*http.Request) ShouldGzipType
+	level                  int
+	minSize                int
+	maxBufferSize          int
+	lookAhead              int
+	ratio                  float64
+	onFallback             func(r *http.Request, size, compressed int)
+	contentTypes           []string
+	excludeContentTypes    []string
+	contentTypeRules       []contentTypeRule
+	sizeTiers              []SizeTier
+	rules                  Rules
+	statusCodes            []StatusCodeRange
+	shouldGzip             func(*http.Request) ShouldGzipType
+	shouldCompressResponse func(*http.Request, int, http.Header, []byte) Decision
+	digests                []DigestAlgorithm
+	noTransform            NoTransformType
+	preciseVary            bool
+	stackEncodings         bool
+	gunzipMaxSize          int64
+	errorHandler           func(*http.Request, *ResponseError)
+
+	// The first error reported by an Option.
+	err error
 }
 
 // Option customizes the behaviour of the gzip handler.
+//
+// Options that are given invalid values cause New to
+// return an error and Gzip to panic.
 type Option func(c *config)
 
 // CompressionLevel is the gzip compression level to apply.
@@ -453,8 +1386,8 @@ type Option func(c *config)
 // The default value adds gzip framing but performs no
 // compression.
 func CompressionLevel(level int) Option {
-	if level < HuffmanOnly || level > BestCompression {
-		panic("gziphandler: invalid compression level requested")
+	if !validLevel(level) {
+		return errorOption("invalid compression level requested: %d", level)
 	}
 
 	return func(c *config) {
@@ -471,7 +1404,7 @@ func CompressionLevel(level int) Option {
 // The default minimum size is 150 bytes.
 func MinSize(size int) Option {
 	if size < 0 {
-		panic("gziphandler: minimum size must not be negative")
+		return errorOption("minimum size must not be negative: %d", size)
 	}
 
 	return func(c *config) {
@@ -479,6 +1412,73 @@ func MinSize(size int) Option {
 	}
 }
 
+// MaxBufferSize specifies the maximum size of a response
+// that will be buffered in memory. Responses that finish
+// within this size are compressed entirely in memory and
+// sent with an exact Content-Length. If compressing the
+// response doesn't make it smaller, it is sent
+// uncompressed instead.
+//
+// Larger responses are streamed, as are responses that
+// are flushed before they complete.
+//
+// If size is zero or less than MinSize, responses are
+// only buffered until they reach MinSize.
+//
+// The default maximum buffer size is zero.
+func MaxBufferSize(size int) Option {
+	if size < 0 {
+		return errorOption("maximum buffer size must not be negative: %d", size)
+	}
+
+	return func(c *config) {
+		c.maxBufferSize = size
+	}
+}
+
+// CompressionRatio makes the handler compress up to
+// lookAhead bytes of the response in scratch space before
+// deciding whether to compress it. If the compressed size
+// is more than ratio times the uncompressed size, the
+// response is sent uncompressed.
+//
+// For example, a ratio of 0.9 sends responses uncompressed
+// unless compression saves at least 10%.
+//
+// The same ratio applies to responses compressed entirely
+// in memory because of MaxBufferSize.
+//
+// By default, all responses that reach MinSize are
+// compressed.
+func CompressionRatio(lookAhead int, ratio float64) Option {
+	if lookAhead < 0 {
+		return errorOption("look-ahead size must not be negative: %d", lookAhead)
+	}
+
+	if ratio <= 0 {
+		return errorOption("compression ratio must be positive: %v", ratio)
+	}
+
+	return func(c *config) {
+		c.lookAhead = lookAhead
+		c.ratio = ratio
+	}
+}
+
+// OnFallback registers a function that is called each time
+// a response is sent uncompressed because compression did
+// not pay off, either because of CompressionRatio or because
+// compressing made a buffered response larger.
+//
+// size is the number of uncompressed bytes that were
+// examined and compressed is the size they compressed to.
+// It can be used to tune CompressionRatio.
+func OnFallback(fn func(r *http.Request, size, compressed int)) Option {
+	return func(c *config) {
+		c.onFallback = fn
+	}
+}
+
 // ContentTypes specifies a list of MIME types to compare
 // the Content-Type header to before compressing. If none
 // match, the response will be returned as-is.
@@ -504,6 +1504,256 @@ func ContentTypes(types []string) Option {
 	}
 }
 
+// ExcludeContentTypes specifies a list of MIME types that
+// will never be compressed. If any match the Content-Type
+// header, the response will be returned as-is.
+//
+// MIME types are compared in the same way as for
+// ContentTypes. Exclusions take precedence over
+// ContentTypes, e.g. text/* may be compressed while
+// text/event-stream is excluded.
+//
+// By default, no Content-Type is excluded.
+func ExcludeContentTypes(types []string) Option {
+	types = append([]string(nil), types...)
+
+	return func(c *config) {
+		c.excludeContentTypes = types
+	}
+}
+
+// ErrorHandler specifies a function that is called with
+// any error encountered while writing, flushing or closing
+// a response. The error is always a *ResponseError.
+//
+// By default, errors are logged with httputils.RequestLogf,
+// except for those caused by the client going away, such
+// as a broken pipe or a connection reset.
+func ErrorHandler(fn func(r *http.Request, err *ResponseError)) Option {
+	return func(c *config) {
+		c.errorHandler = fn
+	}
+}
+
+// Digest computes the Content-Digest and Repr-Digest fields
+// (RFC 9530) of compressed responses with the given
+// algorithms. The digests cover the gzip encoded bytes that
+// are actually sent and are delivered as trailers, as they
+// can only be known once the body has been compressed.
+//
+// Regardless of this option, any Content-Digest or
+// Repr-Digest field set by the wrapped handler is removed
+// when the response is compressed, as it describes the
+// uncompressed body. Responses that are not compressed are
+// left untouched.
+func Digest(algs ...DigestAlgorithm) Option {
+	for _, alg := range algs {
+		if !alg.valid() {
+			return errorOption("invalid digest algorithm requested: %d", alg)
+		}
+	}
+
+	algs = append([]DigestAlgorithm(nil), algs...)
+
+	return func(c *config) {
+		c.digests = algs
+	}
+}
+
+// PerContentType overrides the compression level and the
+// minimum size for responses whose Content-Type matches one
+// of types. MIME types are matched in the same way as for
+// ContentTypes.
+//
+// The rule is applied once the Content-Type is known,
+// either because the handler set it or because it was
+// inferred from the body. A level chosen by
+// ShouldCompressResponse takes precedence.
+//
+// PerContentType may be given multiple times, in which case
+// the first matching rule is used.
+func PerContentType(types []string, level, minSize int) Option {
+	if !validLevel(level) {
+		return errorOption("invalid compression level requested: %d", level)
+	}
+
+	if minSize < 0 {
+		return errorOption("minimum size must not be negative: %d", minSize)
+	}
+
+	rule := contentTypeRule{
+		types:   append([]string(nil), types...),
+		level:   level,
+		minSize: minSize,
+	}
+
+	return func(c *config) {
+		// Never append into a slice that may be shared
+		// with another config.
+		rules := c.contentTypeRules
+		c.contentTypeRules = append(rules[:len(rules):len(rules)], rule)
+	}
+}
+
+type contentTypeRule struct {
+	types   []string
+	level   int
+	minSize int
+}
+
+// SizeTiers selects the compression level based on the size
+// of the response. Each tier applies to responses of at
+// least Size bytes, with the largest matching tier winning.
+// Responses smaller than every tier use the handler's
+// compression level.
+//
+// The size is taken from the Content-Length header if the
+// handler set one. Otherwise it is the size of the response
+// buffered so far, which is the whole response if it fits
+// within MinSize or MaxBufferSize.
+//
+// A level chosen by PerContentType or
+// ShouldCompressResponse takes precedence.
+func SizeTiers(tiers ...SizeTier) Option {
+	for _, tier := range tiers {
+		if !validLevel(tier.Level) {
+			return errorOption("invalid compression level requested: %d", tier.Level)
+		}
+
+		if tier.Size < 0 {
+			return errorOption("tier size must not be negative: %d", tier.Size)
+		}
+	}
+
+	tiers = append([]SizeTier(nil), tiers...)
+	sort.SliceStable(tiers, func(i, j int) bool {
+		return tiers[i].Size < tiers[j].Size
+	})
+
+	return func(c *config) {
+		c.sizeTiers = tiers
+	}
+}
+
+// SizeTier is a compression level that applies to responses
+// of at least Size bytes. See SizeTiers.
+type SizeTier struct {
+	Size  int `json:"size"`
+	Level int `json:"level"`
+}
+
+// StatusCodes specifies a list of status code ranges for
+// which responses will be compressed. Responses with any
+// other status code will be returned as-is.
+//
+// The status code is checked as soon as WriteHeader is
+// called, so responses that won't be compressed are never
+// buffered. ShouldCompressResponse is not called for them.
+//
+// By default, responses are gzipped regardless of status
+// code.
+func StatusCodes(ranges ...StatusCodeRange) Option {
+	for _, r := range ranges {
+		if r.Min < 100 || r.Max > 999 || r.Min > r.Max {
+			return errorOption("invalid status code range requested: %d-%d", r.Min, r.Max)
+		}
+	}
+
+	ranges = append([]StatusCodeRange(nil), ranges...)
+
+	return func(c *config) {
+		c.statusCodes = ranges
+	}
+}
+
+// StatusCodeRange is an inclusive range of HTTP status
+// codes. A single status code can be given by setting Min
+// and Max to the same value.
+type StatusCodeRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// StackEncodings allows responses that the handler has
+// already encoded to be gzipped on top of that encoding,
+// e.g. a response with Content-Encoding: deflate is sent
+// with Content-Encoding: deflate, gzip. It is intended for
+// upstreams that emit codings which compress poorly, if at
+// all, such as ones that aren't native to HTTP. Responses
+// that are already gzipped are never gzipped again.
+//
+// Regardless of this option, Content-Encoding: identity is
+// treated as no encoding.
+//
+// By default, responses with a Content-Encoding are
+// returned as-is.
+func StackEncodings(enabled bool) Option {
+	return func(c *config) {
+		c.stackEncodings = enabled
+	}
+}
+
+// Gunzip makes the handler decompress responses that the
+// wrapped handler has gzipped, when the client's
+// Accept-Encoding header doesn't accept gzip. This allows
+// precompressed files, or responses from upstreams that
+// always gzip, to be served to any client.
+//
+// The response is decompressed as it is written. The gzip
+// coding is removed from Content-Encoding, Content-Length
+// and Accept-Ranges are removed, and -gunzip is appended to
+// any ETag. Partial (206) responses are left as-is.
+//
+// Whether to decompress is decided by Accept-Encoding
+// alone, so responses that ShouldGzip, a rule or
+// Config.ExcludePaths exclude from compression are still
+// decompressed. Only requests with Cache-Control:
+// no-transform under NoTransform(RequestNoTransform), and
+// responses that ShouldGzip forces to be gzipped, are left
+// alone.
+//
+// maxSize limits the size of a decompressed response. It
+// must be positive. If it is exceeded, or the gzipped
+// response is corrupt, the response is aborted, as if the
+// handler had panicked with http.ErrAbortHandler, so that
+// the client can tell it's incomplete. The error is
+// reported to the ErrorHandler. Decompression runs behind
+// the handler's writes, so it may be returned by a later
+// Write, or only noticed once the handler returns. Flush
+// waits for decompression to catch up before flushing.
+//
+// By default, responses are never decompressed.
+func Gunzip(maxSize int64) Option {
+	if maxSize <= 0 {
+		return errorOption("gunzip size limit must be positive: %d", maxSize)
+	}
+
+	return func(c *config) {
+		c.gunzipMaxSize = maxSize
+	}
+}
+
+// PreciseVary makes the handler only add Accept-Encoding to
+// the Vary header when negotiating it could have changed
+// the response, i.e. when the response is, or would have
+// been, compressed. It is added as the response commits,
+// and isn't duplicated or added alongside Vary: *.
+//
+// Responses that are never compressed, such as those
+// excluded by ContentTypes, StatusCodes or ShouldGzip, or
+// that the handler has already encoded, aren't given Vary.
+// For clients that don't accept gzip, ShouldCompressResponse
+// isn't called, so its decision can't be taken into
+// account.
+//
+// By default, Vary: Accept-Encoding is added to every
+// response.
+func PreciseVary(enabled bool) Option {
+	return func(c *config) {
+		c.preciseVary = enabled
+	}
+}
+
 // ShouldGzip provides control over when the handler should
 // return a gzipped response. It allows handlers to implement
 // logic that doesn't consult the request's Accept-Encoding
@@ -538,6 +1788,101 @@ const (
 	ForceGzip
 )
 
+// NoTransform controls how the handler treats the
+// Cache-Control: no-transform directive, which forbids
+// intermediaries from changing the content coding of a
+// response (RFC 9110, section 7.7).
+//
+// By default, responses that carry no-transform are
+// returned as-is, while the directive is ignored on
+// requests.
+func NoTransform(typ NoTransformType) Option {
+	return func(c *config) {
+		c.noTransform = typ
+	}
+}
+
+// NoTransformType controls how the handler treats the
+// Cache-Control: no-transform directive.
+type NoTransformType int
+
+const (
+	// ResponseNoTransform skips gzipping responses
+	// that carry no-transform.
+	ResponseNoTransform NoTransformType = iota
+
+	// RequestNoTransform skips gzipping responses that
+	// carry no-transform or whose request does.
+	RequestNoTransform
+
+	// IgnoreNoTransform ignores no-transform entirely.
+	// It is intended for origin servers, where the
+	// handler isn't acting as an intermediary.
+	IgnoreNoTransform
+)
+
+// key returns the name of typ used by Settings.
+func (typ NoTransformType) key() string {
+	switch typ {
+	case ResponseNoTransform:
+		return "response"
+	case RequestNoTransform:
+		return "request"
+	case IgnoreNoTransform:
+		return "ignore"
+	default:
+		return "unknown"
+	}
+}
+
+// ShouldCompressResponse provides control over whether an
+// individual response is gzipped. Unlike ShouldGzip, fn is
+// called once the response commits, after the handler has
+// written its headers and the first part of its body, so it
+// can consider the status code, the response headers and a
+// prefix of the uncompressed body.
+//
+// fn is only called for requests that ShouldGzip, or the
+// Accept-Encoding header, allow to be gzipped. It must not
+// retain or modify prefix.
+//
+// Returning a Decision of NegotiateGzip applies the usual
+// checks, SkipGzip returns the response as-is and ForceGzip
+// gzips the response regardless of MinSize, ContentTypes,
+// NoTransform and CompressionRatio. A response that already
+// has a Content-Encoding is never gzipped, unless allowed by
+// StackEncodings.
+func ShouldCompressResponse(fn func(r *http.Request, status int, h http.Header, prefix []byte) Decision) Option {
+	return func(c *config) {
+		c.shouldCompressResponse = fn
+	}
+}
+
+// Decision is returned from a ShouldCompressResponse
+// function. The zero value is equivalent to
+// Decide(NegotiateGzip).
+type Decision struct {
+	typ ShouldGzipType
+
+	level    int
+	setLevel bool
+}
+
+// Decide returns a Decision that uses the handler's
+// compression level.
+func Decide(typ ShouldGzipType) Decision {
+	return Decision{typ: typ}
+}
+
+// WithLevel returns a copy of d that gzips the response at
+// the given compression level instead of the handler's. An
+// invalid level is reported to the ErrorHandler, with an Op
+// of "decide", and the handler's level is used instead.
+func (d Decision) WithLevel(level int) Decision {
+	d.level, d.setLevel = level, true
+	return d
+}
+
 type (
 	// Each of these structs is intentionally small (1 pointer wide) so
 	// as to fit inside an interface{} without causing an allocaction.
@@ -571,17 +1916,85 @@ func (w closeNotifyPusherResponseWriter) CloseNotify() <-chan bool {
 }
 
 func (w hijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return w.ResponseWriter.(http.Hijacker).Hijack()
+	return w.hijack()
 }
 
 func (w closeNotifyHijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return w.ResponseWriter.(http.Hijacker).Hijack()
+	return w.hijack()
+}
+
+// hijack hijacks the underlying connection. Once hijacked,
+// the gzip writer and buffer are released and any
+// further writes fail with http.ErrHijacked.
+//
+// It fails with ErrHijackCommitted once part of the body
+// has been compressed or passed through, as the rest of the
+// response would be lost. A body that is still buffered is
+// sent uncompressed first, just as net/http sends anything
+// written before the connection was hijacked.
+func (w *responseWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if err := w.checkState("Hijack"); err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case !w.state.canMoveTo(stateHijacked):
+		return nil, nil, errors.New("gziphandler: cannot hijack a response that is " + w.state.String())
+	case w.state != stateBuffering && w.written != 0:
+		return nil, nil, ErrHijackCommitted
+	case w.state == stateBuffering && len(*w.buf) != 0:
+		w.WriteHeader(http.StatusOK)
+
+		// WriteHeader may have started pass through mode.
+		if w.state == stateBuffering {
+			if err := w.startPassThrough(); err != nil {
+				w.fail(err)
+				return nil, nil, err
+			}
+		}
+	}
+
+	conn, brw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.release()
+	w.state = stateHijacked
+	return conn, brw, nil
 }
 
 func (w pusherResponseWriter) Push(target string, opts *http.PushOptions) error {
-	return w.ResponseWriter.(http.Pusher).Push(target, opts)
+	return w.push(target, opts)
 }
 
 func (w closeNotifyPusherResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+// push initiates an HTTP/2 server push. The pushed request
+// only has the headers given in opts, so the Accept-Encoding
+// header of the parent request is added, unless the caller
+// set it, for the pushed response to be negotiated in the
+// same way. opts is not modified.
+func (w *responseWriter) push(target string, opts *http.PushOptions) error {
+	ae, ok := w.r.Header["Accept-Encoding"]
+	if ok && (opts == nil || opts.Header["Accept-Encoding"] == nil) {
+		var po http.PushOptions
+		if opts != nil {
+			po = *opts
+		}
+
+		h := make(http.Header, len(po.Header)+1)
+		for k, v := range po.Header {
+			h[k] = v
+		}
+
+		h["Accept-Encoding"] = append([]string(nil), ae...)
+
+		po.Header = h
+		opts = &po
+	}
+
 	return w.ResponseWriter.(http.Pusher).Push(target, opts)
 }
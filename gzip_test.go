@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto/rand"
 	"io"
 	"io/ioutil"
 	"net"
@@ -83,13 +84,13 @@ func TestGzipLevelHandler(t *testing.T) {
 }
 
 func TestCompressionLevelPanicsForInvalid(t *testing.T) {
-	assert.PanicsWithValue(t, "gziphandler: invalid compression level requested", func() {
-		CompressionLevel(-42)
-	}, "CompressionLevel did not panic on invalid level")
+	assert.PanicsWithValue(t, "gziphandler: invalid compression level requested: -42", func() {
+		Gzip(new(dummyHTTPHandler), CompressionLevel(-42))
+	}, "Gzip did not panic on invalid level")
 
-	assert.PanicsWithValue(t, "gziphandler: invalid compression level requested", func() {
-		CompressionLevel(42)
-	}, "CompressionLevel did not panic on invalid level")
+	assert.PanicsWithValue(t, "gziphandler: invalid compression level requested: 42", func() {
+		Gzip(new(dummyHTTPHandler), CompressionLevel(42))
+	}, "Gzip did not panic on invalid level")
 }
 
 func TestGzipHandlerNoBody(t *testing.T) {
@@ -189,9 +190,134 @@ func TestGzipHandlerMinSize(t *testing.T) {
 }
 
 func TestMinSizePanicsForInvalid(t *testing.T) {
-	assert.PanicsWithValue(t, "gziphandler: minimum size must not be negative", func() {
-		MinSize(-10)
-	}, "MinSize did not panic on negative size")
+	assert.PanicsWithValue(t, "gziphandler: minimum size must not be negative: -10", func() {
+		Gzip(new(dummyHTTPHandler), MinSize(-10))
+	}, "Gzip did not panic on negative size")
+}
+
+func TestMaxBufferSize(t *testing.T) {
+	random := make([]byte, 1024)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		gzip   bool
+		length bool
+	}{
+		{"compressible", testBody, true, true},
+		{"incompressible", string(random), false, true},
+		{"too large", testBody + testBody, true, false},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, tc.body[:len(tc.body)/2])
+			io.WriteString(w, tc.body[len(tc.body)/2:])
+		}), MaxBufferSize(len(testBody)))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		assert.Equal(t, http.StatusOK, res.StatusCode, tc.name)
+
+		if tc.gzip {
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), tc.name)
+			assert.Equal(t, gzipStrLevel(tc.body, DefaultCompression), resp.Body.Bytes(), tc.name)
+		} else {
+			assert.Equal(t, "", res.Header.Get("Content-Encoding"), tc.name)
+			assert.Equal(t, tc.body, resp.Body.String(), tc.name)
+		}
+
+		if tc.length {
+			assert.Equal(t, strconv.Itoa(resp.Body.Len()), res.Header.Get("Content-Length"), tc.name)
+		} else {
+			assert.Equal(t, "", res.Header.Get("Content-Length"), tc.name)
+		}
+	}
+}
+
+func TestMaxBufferSizeFlush(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody[:len(testBody)/2])
+		w.(http.Flusher).Flush()
+		io.WriteString(w, testBody[len(testBody)/2:])
+	}), MaxBufferSize(len(testBody)))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	res := resp.Result()
+	assert.True(t, resp.Flushed, "Flush did not call underlying http.Flusher")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header.Get("Content-Length"))
+
+	gr, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+
+	body, err := ioutil.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, testBody, string(body))
+}
+
+func TestMaxBufferSizeDigest(t *testing.T) {
+	handler := newDigestTestHandler(MaxBufferSize(len(testBody)), Digest(SHA256))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	res := resp.Result()
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, sha256Field(resp.Body.Bytes()), res.Header.Get("Repr-Digest"))
+	assert.Empty(t, res.Trailer)
+}
+
+func TestCompressionRatio(t *testing.T) {
+	random := make([]byte, 2048)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		body     string
+		gzip     bool
+		fallback int
+	}{
+		{"compressible", testBody, true, 0},
+		{"compressible, within look-ahead", smallTestBody, true, 0},
+		{"incompressible", string(random), false, 512},
+	} {
+		var fallback, compressed int
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, tc.body[:100])
+			io.WriteString(w, tc.body[100:])
+		}), CompressionRatio(512, 0.9), OnFallback(func(r *http.Request, size, c int) {
+			fallback, compressed = size, c
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		if tc.gzip {
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), tc.name)
+			assert.Equal(t, gzipStrLevel(tc.body, DefaultCompression), resp.Body.Bytes(), tc.name)
+		} else {
+			assert.Equal(t, "", res.Header.Get("Content-Encoding"), tc.name)
+			assert.Equal(t, tc.body, resp.Body.String(), tc.name)
+			assert.True(t, compressed > 512*9/10, tc.name)
+		}
+
+		assert.Equal(t, tc.fallback, fallback, tc.name)
+	}
 }
 
 func TestGzipDoubleClose(t *testing.T) {
@@ -243,6 +369,112 @@ func TestStatusCodes(t *testing.T) {
 	assert.Equal(t, http.StatusOK, result.StatusCode)
 }
 
+func TestStatusCodesFilter(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		expect bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusPartialContent, true},
+		{http.StatusFound, false},
+		{http.StatusNotFound, true},
+		{http.StatusInternalServerError, false},
+	} {
+		var called bool
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			io.WriteString(w, testBody)
+		}), StatusCodes(
+			StatusCodeRange{http.StatusOK, 299},
+			StatusCodeRange{http.StatusNotFound, http.StatusNotFound},
+		), ShouldCompressResponse(func(*http.Request, int, http.Header, []byte) Decision {
+			called = true
+			return Decide(NegotiateGzip)
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		assert.Equal(t, tc.status, res.StatusCode, "%+v", tc)
+		assert.Equal(t, tc.expect, called, "%+v", tc)
+
+		if tc.expect {
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "%+v", tc)
+			assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), resp.Body.Bytes(), "%+v", tc)
+		} else {
+			assert.Equal(t, "", res.Header.Get("Content-Encoding"), "%+v", tc)
+			assert.Equal(t, testBody, resp.Body.String(), "%+v", tc)
+		}
+	}
+}
+
+func TestStatusCodesFilterWriteHeader(t *testing.T) {
+	resp := httptest.NewRecorder()
+
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/elsewhere")
+		w.WriteHeader(http.StatusFound)
+
+		assert.Equal(t, http.StatusFound, resp.Code, "WriteHeader did not pass through")
+		io.WriteString(w, "Found")
+	}), StatusCodes(StatusCodeRange{http.StatusOK, 299}), MinSize(0))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(resp, req)
+
+	res := resp.Result()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Found", resp.Body.String())
+}
+
+// informationalRecorder records informational responses
+// which httptest.ResponseRecorder would treat as final.
+type informationalRecorder struct {
+	*httptest.ResponseRecorder
+	informational []int
+	links         []string
+}
+
+func (w *informationalRecorder) WriteHeader(code int) {
+	if code >= 100 && code <= 199 {
+		w.informational = append(w.informational, code)
+		w.links = append(w.links, w.Header().Get("Link"))
+		return
+	}
+
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func TestInformationalStatusCodes(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+
+		w.Header().Del("Link")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, testBody)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := &informationalRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, []int{http.StatusEarlyHints}, resp.informational)
+	assert.Equal(t, []string{"</style.css>; rel=preload; as=style"}, resp.links)
+
+	res := resp.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header.Get("Link"))
+	assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), resp.Body.Bytes())
+}
+
 type httpFlusherFunc func()
 
 func (fn httpFlusherFunc) Flush() { fn() }
@@ -477,6 +709,54 @@ func TestResponseWriterTypes(t *testing.T) {
 	assert.True(t, pushed, "Push did not call underlying http.Pusher")
 }
 
+func TestPushAcceptEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		opts   *http.PushOptions
+		expect []string
+	}{
+		{nil, []string{"gzip, br"}},
+		{&http.PushOptions{Method: http.MethodHead}, []string{"gzip, br"}},
+		{&http.PushOptions{Header: http.Header{"X-Foo": {"bar"}}}, []string{"gzip, br"}},
+		{&http.PushOptions{Header: http.Header{"Accept-Encoding": {"identity"}}}, []string{"identity"}},
+		{&http.PushOptions{Header: http.Header{"Accept-Encoding": {}}}, []string{}},
+	} {
+		var orig http.Header
+		if tc.opts != nil && tc.opts.Header != nil {
+			orig = make(http.Header)
+			for k, v := range tc.opts.Header {
+				orig[k] = v
+			}
+		}
+
+		var pushed *http.PushOptions
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, w.(http.Pusher).Push("/style.css", tc.opts))
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		handler.ServeHTTP(struct {
+			http.ResponseWriter
+			http.Pusher
+		}{httptest.NewRecorder(), httpPusherFunc(func(target string, opts *http.PushOptions) error {
+			pushed = opts
+			return nil
+		})}, req)
+
+		require.NotNil(t, pushed, "%+v", tc.opts)
+		assert.Equal(t, tc.expect, pushed.Header["Accept-Encoding"], "%+v", tc.opts)
+
+		if tc.opts != nil {
+			assert.Equal(t, tc.opts.Method, pushed.Method)
+			assert.Equal(t, orig, tc.opts.Header, "caller's PushOptions must not be modified")
+
+			for k, v := range tc.opts.Header {
+				assert.Equal(t, v, pushed.Header[k])
+			}
+		}
+	}
+}
+
 func TestContentTypes(t *testing.T) {
 	for _, tt := range []struct {
 		name                 string
@@ -590,6 +870,124 @@ func TestContentTypes(t *testing.T) {
 	}
 }
 
+func TestPerContentType(t *testing.T) {
+	const html = "<!doctype html><p>test</p>"
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+		expect      bool
+		level       int
+	}{
+		{"html", "text/html; charset=utf-8", html, true, BestCompression},
+		{"html, sniffed", "", html, true, BestCompression},
+		{"json", "application/json", testBody, true, BestSpeed},
+		{"json, small", "application/json", smallTestBody, false, 0},
+		{"no match", "text/plain", testBody, true, DefaultCompression},
+		{"no match, sniffed", "", testBody, true, DefaultCompression},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.contentType != "" {
+				w.Header().Set("Content-Type", tc.contentType)
+			}
+
+			io.WriteString(w, tc.body)
+		}),
+			PerContentType([]string{"text/html"}, BestCompression, 0),
+			PerContentType([]string{"application/json", "text/html"}, BestSpeed, 1000),
+		)
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		if tc.expect {
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), tc.name)
+			assert.Equal(t, gzipStrLevel(tc.body, tc.level), resp.Body.Bytes(), tc.name)
+		} else {
+			assert.Equal(t, "", res.Header.Get("Content-Encoding"), tc.name)
+			assert.Equal(t, tc.body, resp.Body.String(), tc.name)
+		}
+	}
+}
+
+func TestSizeTiers(t *testing.T) {
+	bin, err := ioutil.ReadFile("testdata/benchmark.json")
+	require.NoError(t, err)
+
+	opt := SizeTiers(
+		SizeTier{Size: 64 << 10, Level: BestSpeed},
+		SizeTier{Size: 0, Level: BestCompression},
+		SizeTier{Size: 10 << 10, Level: DefaultCompression},
+	)
+
+	for _, tc := range []struct {
+		size          int
+		contentLength bool
+		level         int
+	}{
+		// Without a Content-Length, the level is chosen
+		// from the first write.
+		{2048, false, BestCompression},
+		{20480, false, BestCompression},
+		{102400, false, BestCompression},
+		{2048, true, BestCompression},
+		{20480, true, DefaultCompression},
+		{102400, true, BestSpeed},
+	} {
+		body := bin[:tc.size]
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.contentLength {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+
+			for b := body; len(b) != 0; b = b[1024:] {
+				w.Write(b[:1024])
+			}
+		}), opt)
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "%+v", tc)
+
+		var buf bytes.Buffer
+		gw, _ := gzip.NewWriterLevel(&buf, tc.level)
+		for b := body; len(b) != 0; b = b[1024:] {
+			gw.Write(b[:1024])
+		}
+		gw.Close()
+
+		assert.Equal(t, buf.Bytes(), resp.Body.Bytes(), "%+v", tc)
+	}
+}
+
+func TestSizeTiersBuffered(t *testing.T) {
+	bin, err := ioutil.ReadFile("testdata/benchmark.json")
+	require.NoError(t, err)
+
+	body := string(bin[:20480])
+	handler := newTestHandler(body, MaxBufferSize(len(body)), SizeTiers(
+		SizeTier{Size: 0, Level: BestCompression},
+		SizeTier{Size: 10 << 10, Level: BestSpeed},
+	))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	res := resp.Result()
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, gzipStrLevel(body, BestSpeed), resp.Body.Bytes())
+}
+
 func TestContentTypesMultiWrite(t *testing.T) {
 	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "example/mismatch")
@@ -610,6 +1008,40 @@ func TestContentTypesMultiWrite(t *testing.T) {
 	assert.Equal(t, testBody+testBody, resp.Body.String())
 }
 
+func TestExcludeContentTypes(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		expect      bool
+	}{
+		{"text/html", true},
+		{"text/event-stream", false},
+		{"Text/Event-Stream; charset=utf-8", false},
+		{"image/png", false},
+		{"", false},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.contentType != "" {
+				w.Header().Set("Content-Type", tc.contentType)
+			}
+
+			io.WriteString(w, testBody)
+		}), ExcludeContentTypes([]string{"text/event-stream", "image/*", "text/plain"}))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		if tc.expect {
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "%+v", tc)
+		} else {
+			assert.Equal(t, "", res.Header.Get("Content-Encoding"), "%+v", tc)
+			assert.Equal(t, testBody, resp.Body.String(), "%+v", tc)
+		}
+	}
+}
+
 func TestContentTypesCopies(t *testing.T) {
 	s := []string{"application/example"}
 
@@ -635,28 +1067,96 @@ func TestGzipHandlerAlreadyCompressed(t *testing.T) {
 	assert.Equal(t, testBody, res.Body.String())
 }
 
-func TestReleaseBufferPanicsInvaraiant(t *testing.T) {
-	assert.PanicsWithValue(t, "gziphandler: w.buf is nil in call to emptyBuffer", func() {
-		new(responseWriter).releaseBuffer()
-	}, "releaseBuffer did not panic with nil buf")
+func TestGzipHandlerIdentityEncoding(t *testing.T) {
+	for _, encoding := range []string{"identity", "Identity", " , identity"} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", encoding)
+			io.WriteString(w, testBody)
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		assert.Equal(t, []string{"gzip"}, res.Result().Header["Content-Encoding"], encoding)
+		assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), res.Body.Bytes(), encoding)
+	}
 }
 
-func TestWritePanicsInvariant(t *testing.T) {
-	assert.PanicsWithValue(t, "gziphandler: both buf and gw are non nil in call to Write", func() {
-		(&responseWriter{
-			gw:  new(gzip.Writer),
-			buf: new([]byte),
-		}).Write(nil)
-	}, "Write did not panic with both gw and buf non-nil")
+func TestStackEncodings(t *testing.T) {
+	for _, tc := range []struct {
+		encoding string
+		expect   string
+	}{
+		{"deflate", "deflate, gzip"},
+		{"x-custom, identity", "x-custom, gzip"},
+		{"identity", "gzip"},
+		{"gzip", ""},
+		{"deflate, X-Gzip", ""},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", tc.encoding)
+			io.WriteString(w, testBody)
+		}), StackEncodings(true))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		if tc.expect == "" {
+			assert.Equal(t, tc.encoding, res.Result().Header.Get("Content-Encoding"))
+			assert.Equal(t, testBody, res.Body.String())
+			continue
+		}
+
+		assert.Equal(t, tc.expect, res.Result().Header.Get("Content-Encoding"))
+		assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), res.Body.Bytes())
+	}
 }
 
-func TestClosePanicsInvariant(t *testing.T) {
-	assert.PanicsWithValue(t, "gziphandler: both buf and gw are non nil in call to Close", func() {
-		(&responseWriter{
-			gw:  new(gzip.Writer),
-			buf: new([]byte),
-		}).Close()
-	}, "Close did not panic with both gw and buf non-nil")
+func TestNoTransform(t *testing.T) {
+	for _, tc := range []struct {
+		typ      NoTransformType
+		request  string
+		response string
+		expect   bool
+	}{
+		{ResponseNoTransform, "", "", true},
+		{ResponseNoTransform, "", "public, No-Transform", false},
+		{ResponseNoTransform, "no-transform", "", true},
+		{RequestNoTransform, "", "no-transform", false},
+		{RequestNoTransform, "no-cache, no-transform", "", false},
+		{RequestNoTransform, "no-cache", "max-age=60", true},
+		{IgnoreNoTransform, "no-transform", "no-transform", true},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.response != "" {
+				w.Header().Set("Cache-Control", tc.response)
+			}
+
+			io.WriteString(w, testBody)
+		}), NoTransform(tc.typ))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if tc.request != "" {
+			req.Header.Set("Cache-Control", tc.request)
+		}
+
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		if tc.expect {
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "%+v", tc)
+			assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), resp.Body.Bytes(), "%+v", tc)
+		} else {
+			assert.Equal(t, "", res.Header.Get("Content-Encoding"), "%+v", tc)
+			assert.Equal(t, testBody, resp.Body.String(), "%+v", tc)
+		}
+	}
 }
 
 // we use an int and not a struct{} as the latter is not
@@ -713,6 +1213,257 @@ func TestShouldGzip(t *testing.T) {
 	}
 }
 
+func TestShouldCompressResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		status   int
+		body     string
+		encoding string
+		decision Decision
+		expect   bool
+		level    int
+	}{
+		{"negotiate", http.StatusOK, testBody, "", Decision{}, true, DefaultCompression},
+		{"negotiate, small", http.StatusOK, "test", "", Decide(NegotiateGzip), false, DefaultCompression},
+		{"skip", http.StatusOK, testBody, "", Decide(SkipGzip), false, DefaultCompression},
+		{"force, small", http.StatusOK, "test", "", Decide(ForceGzip), true, DefaultCompression},
+		{"force, encoded", http.StatusOK, testBody, "br", Decide(ForceGzip), false, DefaultCompression},
+		{"level", http.StatusOK, testBody, "", Decide(NegotiateGzip).WithLevel(BestSpeed), true, BestSpeed},
+		{"status", http.StatusNotFound, testBody, "", Decide(SkipGzip), false, DefaultCompression},
+	} {
+		var status int
+		var prefix string
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.encoding != "" {
+				w.Header().Set("Content-Encoding", tc.encoding)
+			}
+
+			w.WriteHeader(tc.status)
+			io.WriteString(w, tc.body)
+		}), ShouldCompressResponse(func(r *http.Request, s int, h http.Header, p []byte) Decision {
+			status, prefix = s, string(p)
+			return tc.decision
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		assert.Equal(t, tc.status, res.StatusCode, tc.name)
+		assert.Equal(t, tc.status, status, tc.name)
+		assert.Equal(t, tc.body, prefix, tc.name)
+
+		if tc.expect {
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), tc.name)
+			assert.Equal(t, gzipStrLevel(tc.body, tc.level), resp.Body.Bytes(), tc.name)
+		} else {
+			assert.NotEqual(t, "gzip", res.Header.Get("Content-Encoding"), tc.name)
+			assert.Equal(t, tc.body, resp.Body.String(), tc.name)
+		}
+	}
+}
+
+func TestDecisionWithLevelInvalid(t *testing.T) {
+	var reported []*ResponseError
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}), ShouldCompressResponse(func(r *http.Request, s int, h http.Header, p []byte) Decision {
+		return Decide(NegotiateGzip).WithLevel(42)
+	}), ErrorHandler(func(r *http.Request, err *ResponseError) {
+		reported = append(reported, err)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, "gzip", resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), resp.Body.Bytes())
+
+	require.Len(t, reported, 1)
+	assert.Equal(t, "decide", reported[0].Op)
+	assert.Equal(t, "gziphandler: error during decide: invalid compression level requested: 42", reported[0].Error())
+}
+
+func TestUpdate(t *testing.T) {
+	handler, err := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}), MinSize(len(testBody)+1))
+	require.NoError(t, err)
+
+	serve := func() *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Result()
+	}
+
+	assert.Equal(t, "", serve().Header.Get("Content-Encoding"))
+
+	require.NoError(t, handler.Update(MinSize(len(testBody))))
+	assert.Equal(t, "gzip", serve().Header.Get("Content-Encoding"))
+
+	assert.EqualError(t, handler.Update(MinSize(-10)),
+		"gziphandler: minimum size must not be negative: -10")
+	assert.Equal(t, "gzip", serve().Header.Get("Content-Encoding"),
+		"invalid Update must leave options unchanged")
+
+	require.NoError(t, handler.Update(ContentTypes([]string{"image/png"})))
+	assert.Equal(t, "", serve().Header.Get("Content-Encoding"))
+}
+
+func TestUpdateInFlight(t *testing.T) {
+	started, resume := make(chan struct{}), make(chan struct{})
+
+	handler, err := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-resume
+
+		io.WriteString(w, testBody)
+	}))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(resp, req)
+	}()
+
+	<-started
+	require.NoError(t, handler.Update(ShouldGzip(func(*http.Request) ShouldGzipType {
+		return SkipGzip
+	})))
+	close(resume)
+	<-done
+
+	assert.Equal(t, "gzip", resp.Result().Header.Get("Content-Encoding"))
+	assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), resp.Body.Bytes())
+}
+
+func TestGzipHandlerPanic(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		value interface{}
+		flush bool
+	}{
+		{"ErrAbortHandler", http.ErrAbortHandler, true},
+		{"ErrAbortHandler buffered", http.ErrAbortHandler, false},
+		{"other", "boom", true},
+	} {
+		var rw *responseWriter
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw = w.(*responseWriter)
+
+			io.WriteString(w, testBody)
+			if tc.flush {
+				w.(http.Flusher).Flush()
+			}
+
+			panic(tc.value)
+		}), MaxBufferSize(4096))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+
+		assert.PanicsWithValue(t, tc.value, func() {
+			handler.ServeHTTP(resp, req)
+		}, tc.name)
+
+		assert.Nil(t, rw.gw, "%s: gzip writer should be released", tc.name)
+		assert.Nil(t, rw.buf, "%s: buffer should be released", tc.name)
+
+		if !tc.flush {
+			assert.Equal(t, 0, resp.Body.Len(), tc.name)
+			continue
+		}
+
+		// The gzip stream must not have been finished.
+		gr, err := gzip.NewReader(resp.Body)
+		require.NoError(t, err, tc.name)
+
+		_, err = ioutil.ReadAll(gr)
+		assert.Equal(t, io.ErrUnexpectedEOF, err, tc.name)
+	}
+}
+
+func TestPreciseVary(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		acceptEncoding string
+		vary           []string
+		contentType    string
+		encoding       string
+		body           string
+		opts           []Option
+		expect         []string
+	}{
+		{"compressed", "gzip", nil, "", "", testBody, nil, []string{"Accept-Encoding"}},
+		{"compressed in memory", "gzip", nil, "", "", testBody, []Option{MaxBufferSize(4096)}, []string{"Accept-Encoding"}},
+		{"merged", "gzip", []string{"Origin"}, "", "", testBody, nil, []string{"Origin", "Accept-Encoding"}},
+		{"already listed", "gzip", []string{"Origin, accept-encoding"}, "", "", testBody, nil, []string{"Origin, accept-encoding"}},
+		{"star", "gzip", []string{"*"}, "", "", testBody, nil, []string{"*"}},
+		{"excluded", "gzip", nil, "image/png", "", testBody, nil, nil},
+		{"encoded", "gzip", nil, "", "br", testBody, nil, nil},
+		{"too small", "gzip", nil, "", "", "small", nil, nil},
+		{"identity", "", nil, "", "", testBody, nil, []string{"Accept-Encoding"}},
+		{"identity in memory", "identity", nil, "", "", testBody, []Option{MaxBufferSize(4096)}, []string{"Accept-Encoding"}},
+		{"identity excluded", "", nil, "image/png", "", testBody, nil, nil},
+		{"identity too small", "", nil, "", "", "small", nil, nil},
+		{"forced", "", nil, "", "", testBody, []Option{ShouldGzip(func(*http.Request) ShouldGzipType { return ForceGzip })}, nil},
+		{"skipped", "gzip", nil, "", "", testBody, []Option{ShouldGzip(skipGzip)}, nil},
+		{"identity with callback", "", nil, "", "", testBody, []Option{ShouldCompressResponse(func(*http.Request, int, http.Header, []byte) Decision {
+			t.Error("ShouldCompressResponse called for a client that doesn't accept gzip")
+			return Decide(SkipGzip)
+		})}, []string{"Accept-Encoding"}},
+		{"identity in memory with callback", "", nil, "", "", testBody, []Option{MaxBufferSize(4096), ShouldCompressResponse(func(*http.Request, int, http.Header, []byte) Decision {
+			t.Error("ShouldCompressResponse called for a client that doesn't accept gzip")
+			return Decide(SkipGzip)
+		})}, []string{"Accept-Encoding"}},
+	} {
+		opts := append([]Option{PreciseVary(true), ContentTypes([]string{"text/*"})}, tc.opts...)
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.vary != nil {
+				w.Header()["Vary"] = tc.vary
+			}
+
+			if tc.contentType != "" {
+				w.Header().Set("Content-Type", tc.contentType)
+			}
+
+			if tc.encoding != "" {
+				w.Header().Set("Content-Encoding", tc.encoding)
+			}
+
+			io.WriteString(w, tc.body)
+		}), opts...)
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		if tc.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		assert.Equal(t, tc.expect, res.Header["Vary"], tc.name)
+
+		if tc.acceptEncoding != "gzip" && tc.opts == nil {
+			assert.Equal(t, tc.encoding, res.Header.Get("Content-Encoding"), tc.name)
+			assert.Equal(t, tc.body, resp.Body.String(), tc.name)
+		}
+	}
+}
+
 // --------------------------------------------------------------------
 
 func BenchmarkGzipHandler_S2k(b *testing.B)   { benchmark(b, false, 2048) }
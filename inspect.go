@@ -0,0 +1,200 @@
+package gziphandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// Snapshot describes the effective settings of a Handler
+// and the responses it has served so far.
+type Snapshot struct {
+	Settings Settings `json:"settings"`
+	Stats    Stats    `json:"stats"`
+}
+
+// Settings are the effective settings of a Handler, after
+// every option has been applied. Settings that were not
+// set by an option hold their default.
+type Settings struct {
+	Level               int               `json:"level"`
+	MinSize             int               `json:"minSize"`
+	MaxBufferSize       int               `json:"maxBufferSize"`
+	LookAhead           int               `json:"lookAhead,omitempty"`
+	Ratio               float64           `json:"ratio,omitempty"`
+	ContentTypes        []string          `json:"contentTypes,omitempty"`
+	ExcludeContentTypes []string          `json:"excludeContentTypes,omitempty"`
+	SizeTiers           []SizeTier        `json:"sizeTiers,omitempty"`
+	StatusCodes         []StatusCodeRange `json:"statusCodes,omitempty"`
+	Digests             []string          `json:"digests,omitempty"`
+
+	// PerContentType are the overrides given to
+	// PerContentType, in the order they're checked.
+	PerContentType []ContentTypeSettings `json:"perContentType,omitempty"`
+
+	// NoTransform is the mode given to NoTransform:
+	// "response", "request" or "ignore".
+	NoTransform string `json:"noTransform"`
+
+	// PreciseVary is the setting given to PreciseVary.
+	PreciseVary bool `json:"preciseVary,omitempty"`
+
+	// StackEncodings is the setting given to
+	// StackEncodings.
+	StackEncodings bool `json:"stackEncodings,omitempty"`
+
+	// GunzipMaxSize is the size limit given to Gunzip,
+	// or zero if gzipped responses aren't decompressed.
+	GunzipMaxSize int64 `json:"gunzipMaxSize,omitempty"`
+
+	// ShouldGzip, ShouldCompressResponse, OnFallback and
+	// ErrorHandler report whether a function was given to
+	// the option of the same name. Logger sets
+	// ErrorHandler.
+	ShouldGzip             bool `json:"shouldGzip,omitempty"`
+	ShouldCompressResponse bool `json:"shouldCompressResponse,omitempty"`
+	OnFallback             bool `json:"onFallback,omitempty"`
+	ErrorHandler           bool `json:"errorHandler,omitempty"`
+
+	// Rules is the number of rules passed to WithRules.
+	// The settings of the rules themselves are not
+	// included.
+	Rules int `json:"rules,omitempty"`
+}
+
+// ContentTypeSettings are the settings given to a call to
+// PerContentType.
+type ContentTypeSettings struct {
+	Types   []string `json:"types"`
+	Level   int      `json:"level"`
+	MinSize int      `json:"minSize"`
+}
+
+// Stats are counters of the responses a Handler has served.
+// They are never reset, not even by Update.
+type Stats struct {
+	// Requests is the number of requests served.
+	Requests uint64 `json:"requests"`
+
+	// Compressed is the number of responses that were
+	// gzipped.
+	Compressed uint64 `json:"compressed"`
+
+	// Uncompressed is the number of responses that were
+	// sent as-is, whether because the client doesn't
+	// accept gzip or because of the options.
+	Uncompressed uint64 `json:"uncompressed"`
+
+	// BytesIn is the number of bytes written by the
+	// wrapped handler to responses that were compressed.
+	BytesIn uint64 `json:"bytesIn"`
+
+	// BytesOut is the number of bytes those responses
+	// were compressed to.
+	BytesOut uint64 `json:"bytesOut"`
+}
+
+// counters are the live counterparts to Stats. They must
+// only be accessed atomically.
+type counters struct {
+	requests     uint64
+	compressed   uint64
+	uncompressed uint64
+	bytesIn      uint64
+	bytesOut     uint64
+}
+
+// statsWriter counts the bytes written through it to the
+// response into bytesOut.
+type statsWriter struct {
+	http.ResponseWriter
+	stats *counters
+}
+
+func (sw statsWriter) Write(p []byte) (int, error) {
+	n, err := sw.ResponseWriter.Write(p)
+	atomic.AddUint64(&sw.stats.bytesOut, uint64(n))
+	return n, err
+}
+
+// Inspect returns a snapshot of the settings and counters
+// of h. It reports false if h was not returned by Gzip,
+// New or a function returned by Wrapper.
+func Inspect(h http.Handler) (Snapshot, bool) {
+	gzh, ok := h.(*Handler)
+	if !ok {
+		return Snapshot{}, false
+	}
+
+	return gzh.Snapshot(), true
+}
+
+// Snapshot returns the current settings and counters of the
+// handler. The returned Snapshot is a copy and is not
+// affected by later requests or calls to Update.
+func (h *Handler) Snapshot() Snapshot {
+	hc := h.config.Load().(*handlerConfig)
+
+	s := Settings{
+		Level:               hc.level,
+		MinSize:             hc.minSize,
+		MaxBufferSize:       hc.maxBufferSize,
+		LookAhead:           hc.lookAhead,
+		Ratio:               hc.ratio,
+		ContentTypes:        append([]string(nil), hc.contentTypes...),
+		ExcludeContentTypes: append([]string(nil), hc.excludeContentTypes...),
+		SizeTiers:           append([]SizeTier(nil), hc.sizeTiers...),
+		StatusCodes:         append([]StatusCodeRange(nil), hc.statusCodes...),
+		NoTransform:         hc.noTransform.key(),
+		PreciseVary:         hc.preciseVary,
+		StackEncodings:      hc.stackEncodings,
+		GunzipMaxSize:       hc.gunzipMaxSize,
+
+		ShouldGzip:             hc.shouldGzip != nil,
+		ShouldCompressResponse: hc.shouldCompressResponse != nil,
+		OnFallback:             hc.onFallback != nil,
+		ErrorHandler:           hc.errorHandler != nil,
+
+		Rules: len(hc.compiled),
+	}
+
+	for _, rule := range hc.contentTypeRules {
+		s.PerContentType = append(s.PerContentType, ContentTypeSettings{
+			Types:   append([]string(nil), rule.types...),
+			Level:   rule.level,
+			MinSize: rule.minSize,
+		})
+	}
+
+	for _, alg := range hc.digests {
+		s.Digests = append(s.Digests, alg.key())
+	}
+
+	return Snapshot{
+		Settings: s,
+		Stats: Stats{
+			Requests:     atomic.LoadUint64(&h.stats.requests),
+			Compressed:   atomic.LoadUint64(&h.stats.compressed),
+			Uncompressed: atomic.LoadUint64(&h.stats.uncompressed),
+			BytesIn:      atomic.LoadUint64(&h.stats.bytesIn),
+			BytesOut:     atomic.LoadUint64(&h.stats.bytesOut),
+		},
+	}
+}
+
+// DebugHandler returns an http.Handler that renders the
+// handler's Snapshot as JSON. It is intended for internal
+// debug pages and should not be exposed publicly.
+func (h *Handler) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.MarshalIndent(h.Snapshot(), "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(append(b, '\n'))
+	})
+}
@@ -0,0 +1,104 @@
+package gziphandler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}), CompressionLevel(BestSpeed), ContentTypes([]string{"text/plain"}), Digest(SHA256),
+		WithRules(Rules{{Match: PathPrefix("/raw/"), Options: []Option{ShouldGzip(skipGzip)}}}),
+		PreciseVary(true), StackEncodings(true), Gunzip(1<<20))
+
+	s, ok := Inspect(handler)
+	require.True(t, ok)
+	assert.Equal(t, Settings{
+		Level:          BestSpeed,
+		MinSize:        defaultMinSize,
+		MaxBufferSize:  0,
+		ContentTypes:   []string{"text/plain"},
+		Digests:        []string{"sha-256"},
+		NoTransform:    "response",
+		PreciseVary:    true,
+		StackEncodings: true,
+		GunzipMaxSize:  1 << 20,
+		Rules:          1,
+	}, s.Settings)
+	assert.Equal(t, Stats{}, s.Stats)
+
+	for _, path := range []string{"/", "/raw/"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	s, _ = Inspect(handler)
+	assert.Equal(t, Stats{
+		Requests:     3,
+		Compressed:   1,
+		Uncompressed: 2,
+		BytesIn:      uint64(len(testBody)),
+		BytesOut:     uint64(len(gzipStrLevel(testBody, BestSpeed))),
+	}, s.Stats)
+
+	_, ok = Inspect(new(dummyHTTPHandler))
+	assert.False(t, ok)
+}
+
+func TestInspectSettings(t *testing.T) {
+	handler, err := New(new(dummyHTTPHandler),
+		PerContentType([]string{"application/json"}, BestSpeed, 0),
+		NoTransform(RequestNoTransform),
+		ShouldGzip(func(*http.Request) ShouldGzipType { return NegotiateGzip }),
+		OnFallback(func(*http.Request, int, int) {}),
+		ErrorHandler(func(*http.Request, *ResponseError) {}))
+	require.NoError(t, err)
+
+	s := handler.Snapshot().Settings
+	assert.Equal(t, []ContentTypeSettings{
+		{Types: []string{"application/json"}, Level: BestSpeed, MinSize: 0},
+	}, s.PerContentType)
+	assert.Equal(t, "request", s.NoTransform)
+	assert.True(t, s.ShouldGzip)
+	assert.False(t, s.ShouldCompressResponse)
+	assert.True(t, s.OnFallback)
+	assert.True(t, s.ErrorHandler)
+}
+
+func TestInspectUpdate(t *testing.T) {
+	handler, err := New(new(dummyHTTPHandler))
+	require.NoError(t, err)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	require.NoError(t, handler.Update(MinSize(42)))
+
+	s := handler.Snapshot()
+	assert.Equal(t, 42, s.Settings.MinSize)
+	assert.Equal(t, uint64(1), s.Stats.Requests, "counters must survive Update")
+}
+
+func TestDebugHandler(t *testing.T) {
+	handler, err := New(new(dummyHTTPHandler), SizeTiers(SizeTier{Size: 4096, Level: BestCompression}))
+	require.NoError(t, err)
+
+	resp := httptest.NewRecorder()
+	handler.DebugHandler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/debug/gzip", nil))
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+
+	var s Snapshot
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &s))
+	assert.Equal(t, handler.Snapshot(), s)
+	assert.Contains(t, resp.Body.String(), `"sizeTiers": [`)
+}
@@ -0,0 +1,115 @@
+package gziphandler
+
+// The presets below bundle options for common workloads.
+// They are ordinary Options, so any option given after a
+// preset overrides the setting it chose, e.g.
+//
+//	Gzip(h, PresetJSONAPI(), MinSize(0))
+//
+// The compression levels were chosen from the
+// BenchmarkCompressionLevel benchmarks, which compress
+// testdata/benchmark.json, a JSON document typical of API
+// responses. Relative to BestSpeed, on the 100KiB sample:
+//
+//	level            size    time
+//	HuffmanOnly      61%     0.5x
+//	BestSpeed        29%     1x
+//	4                27%     1.6x
+//	6                25%     2x
+//	BestCompression  24%     12x
+//
+// BestCompression is never chosen: it is six times slower
+// than level 6 for a saving of about one percent of the
+// uncompressed size.
+
+// PresetStaticAssets is suited to serving files such as
+// HTML, CSS, JavaScript, SVG and fonts.
+//
+// It compresses at level 6, as the same bytes are usually
+// served many times and are often cached downstream, making
+// the smaller output worth twice the compression time of
+// BestSpeed. Formats that are already compressed, such as
+// raster images, video and WOFF fonts, are not compressed.
+func PresetStaticAssets() Option {
+	return presetOptions(
+		CompressionLevel(6),
+		ContentTypes([]string{
+			"text/*",
+			"application/javascript",
+			"application/json",
+			"application/manifest+json",
+			"application/wasm",
+			"application/xml",
+			"application/vnd.ms-fontobject",
+			"font/otf",
+			"font/ttf",
+			"image/svg+xml",
+			"image/x-icon",
+		}),
+		ExcludeContentTypes([]string{"text/event-stream"}),
+	)
+}
+
+// PresetJSONAPI is suited to APIs that respond with JSON.
+//
+// It compresses at level 4, whose output is within two
+// percent of the uncompressed size of level 6's at about
+// four-fifths of the cost.
+// Responses of up to 64KiB are buffered, so they are sent
+// with an exact Content-Length and are sent uncompressed if
+// compression doesn't make them smaller.
+func PresetJSONAPI() Option {
+	return presetOptions(
+		CompressionLevel(4),
+		MaxBufferSize(64<<10),
+		ContentTypes([]string{
+			"application/json",
+			"application/geo+json",
+			"application/ld+json",
+			"application/problem+json",
+			"application/vnd.api+json",
+			"application/x-ndjson",
+		}),
+	)
+}
+
+// PresetStreaming is suited to long-lived responses that
+// are written and flushed incrementally, such as server-sent
+// events.
+//
+// Nothing is buffered, so every write is compressed and
+// sent as soon as the handler flushes. BestSpeed keeps the
+// time added to each flush small.
+func PresetStreaming() Option {
+	return presetOptions(
+		CompressionLevel(BestSpeed),
+		MinSize(0),
+		MaxBufferSize(0),
+	)
+}
+
+// PresetLowLatency is suited to servers where the time to
+// compress matters more than the size of the response, such
+// as those on fast internal networks.
+//
+// It uses HuffmanOnly, which takes half the time of
+// BestSpeed and still shrinks JSON by over a third, and
+// leaves responses smaller than 1KiB uncompressed, as they
+// gain little from Huffman-only coding.
+func PresetLowLatency() Option {
+	return presetOptions(
+		CompressionLevel(HuffmanOnly),
+		MinSize(1<<10),
+		MaxBufferSize(0),
+	)
+}
+
+// presetOptions returns an Option that applies each of opts
+// in turn.
+func presetOptions(opts ...Option) Option {
+	return func(c *config) {
+		for _, opt := range opts {
+			opt(c)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package gziphandler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresets(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		preset      Option
+		contentType string
+		size        int
+		expect      bool
+	}{
+		{"StaticAssets", PresetStaticAssets(), "text/css", 1024, true},
+		{"StaticAssets", PresetStaticAssets(), "image/png", 1024, false},
+		{"StaticAssets", PresetStaticAssets(), "text/event-stream", 1024, false},
+		{"JSONAPI", PresetJSONAPI(), "application/json", 1024, true},
+		{"JSONAPI", PresetJSONAPI(), "text/html", 1024, false},
+		{"Streaming", PresetStreaming(), "text/event-stream", 16, true},
+		{"LowLatency", PresetLowLatency(), "application/json", 1024, true},
+		{"LowLatency", PresetLowLatency(), "application/json", 512, false},
+	} {
+		handler := newTestHandler(strings.Repeat("a", tc.size), tc.preset)
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		resp.Header().Set("Content-Type", tc.contentType)
+		handler.ServeHTTP(resp, req)
+
+		enc := resp.Result().Header.Get("Content-Encoding")
+		if tc.expect {
+			assert.Equal(t, "gzip", enc, "%s %s %d", tc.name, tc.contentType, tc.size)
+		} else {
+			assert.Equal(t, "", enc, "%s %s %d", tc.name, tc.contentType, tc.size)
+		}
+	}
+}
+
+func TestPresetsOverride(t *testing.T) {
+	handler, err := New(new(dummyHTTPHandler), PresetJSONAPI(), CompressionLevel(BestSpeed), MinSize(0))
+	require.NoError(t, err)
+
+	s := handler.Snapshot().Settings
+	assert.Equal(t, BestSpeed, s.Level)
+	assert.Equal(t, 0, s.MinSize)
+	assert.Equal(t, 64<<10, s.MaxBufferSize, "preset setting should be kept")
+
+	for _, preset := range []Option{
+		PresetStaticAssets(),
+		PresetJSONAPI(),
+		PresetStreaming(),
+		PresetLowLatency(),
+	} {
+		_, err := New(new(dummyHTTPHandler), preset)
+		assert.NoError(t, err)
+	}
+}
+
+// BenchmarkCompressionLevel compresses part of
+// testdata/benchmark.json at each level, reporting the
+// compressed size as a ratio of the uncompressed size. The
+// presets were chosen from its results.
+func BenchmarkCompressionLevel(b *testing.B) {
+	bin, err := ioutil.ReadFile("testdata/benchmark.json")
+	require.NoError(b, err)
+
+	for _, size := range []int{2048, 20480, 102400} {
+		for _, level := range []int{HuffmanOnly, BestSpeed, 4, 6, BestCompression} {
+			b.Run(strconv.Itoa(size>>10)+"k/L"+strconv.Itoa(level), func(b *testing.B) {
+				handler := newTestHandler(string(bin[:size]), CompressionLevel(level))
+
+				req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+				req.Header.Set("Accept-Encoding", "gzip")
+
+				var n int
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					res := httptest.NewRecorder()
+					handler.ServeHTTP(res, req)
+					n = res.Body.Len()
+				}
+
+				b.ReportMetric(float64(n)/float64(size), "ratio")
+			})
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package gziphandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tmthrgd/httputils"
+)
+
+var (
+	errBodyClosed = errors.New("gziphandler: read on closed response body")
+	errNotWrapped = errors.New("gziphandler: ReverseProxy with rules must be wrapped with Wrap")
+)
+
+// ReverseProxy negotiates the content coding of responses
+// proxied by an httputil.ReverseProxy. Wrapping a
+// ReverseProxy with Gzip recompresses, or needlessly
+// buffers, bodies the upstream has already dealt with;
+// ReverseProxy instead acts on the upstream response
+// directly. It should be used as both the Transport and
+// the ModifyResponse function of the proxy, which is then
+// wrapped with Wrap:
+//
+//	rp, err := gziphandler.NewReverseProxy(nil)
+//	proxy := &httputil.ReverseProxy{
+//		Director:       director,
+//		Transport:      rp,
+//		ModifyResponse: rp.ModifyResponse,
+//	}
+//	handler := rp.Wrap(proxy)
+//
+// Upstream responses with a content coding the client
+// accepts are passed through untouched. Unencoded
+// responses are compressed with gzip, or deflate if the
+// client only accepts that. Responses encoded with gzip or
+// deflate are transcoded to the other coding when the
+// client only accepts that.
+type ReverseProxy struct {
+	transport http.RoundTripper
+	c         *handlerConfig
+}
+
+type clientRequestKey struct{}
+
+// NewReverseProxy returns a ReverseProxy that sends
+// requests with transport, or http.DefaultTransport if
+// transport is nil.
+//
+// CompressionLevel, MinSize, ContentTypes,
+// ExcludeContentTypes, PerContentType, SizeTiers,
+// StatusCodes, ShouldGzip, NoTransform, PreciseVary and
+// WithRules apply as they do to Gzip. SizeTiers can only
+// use the upstream's Content-Length.
+//
+// MaxBufferSize, CompressionRatio, OnFallback,
+// ShouldCompressResponse, Digest, StackEncodings, Gunzip
+// and ErrorHandler, or Logger, aren't supported, as they
+// rely on the handler buffering or writing the response
+// itself. They're rejected with an error, including within
+// rules.
+func NewReverseProxy(transport http.RoundTripper, opts ...Option) (*ReverseProxy, error) {
+	hc, err := newHandlerConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hc.config.validateProxy(); err != nil {
+		return nil, fmt.Errorf("gziphandler: %v", err)
+	}
+
+	for i := range hc.compiled {
+		if err := hc.compiled[i].config.validateProxy(); err != nil {
+			return nil, fmt.Errorf("gziphandler: rule %d: %v", i, err)
+		}
+	}
+
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &ReverseProxy{transport, hc}, nil
+}
+
+// validateProxy returns an error if c uses an option that
+// ReverseProxy doesn't support.
+func (c *config) validateProxy() error {
+	var opt string
+	switch {
+	case c.maxBufferSize != 0:
+		opt = "MaxBufferSize"
+	case c.lookAhead != 0 || c.ratio != 0:
+		opt = "CompressionRatio"
+	case c.onFallback != nil:
+		opt = "OnFallback"
+	case c.shouldCompressResponse != nil:
+		opt = "ShouldCompressResponse"
+	case len(c.digests) != 0:
+		opt = "Digest"
+	case c.stackEncodings:
+		opt = "StackEncodings"
+	case c.gunzipMaxSize != 0:
+		opt = "Gunzip"
+	case c.errorHandler != nil:
+		opt = "ErrorHandler"
+	default:
+		return nil
+	}
+
+	return fmt.Errorf("%s is not supported by ReverseProxy", opt)
+}
+
+// Wrap returns a handler that serves requests with h, the
+// httputil.ReverseProxy. It records the client's request so
+// that rules are matched, and Accept-Encoding is
+// negotiated, against the request as the client sent it,
+// rather than as rewritten by the proxy's Director.
+//
+// Wrap must be used if WithRules was given; otherwise
+// ModifyResponse fails every response.
+func (p *ReverseProxy) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientRequestKey{}, r)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientRequest returns the client's request recorded by
+// Wrap, or nil if there isn't one.
+func clientRequest(r *http.Request) *http.Request {
+	cr, _ := r.Context().Value(clientRequestKey{}).(*http.Request)
+	return cr
+}
+
+// RoundTrip implements http.RoundTripper. It forwards the
+// client's Accept-Encoding upstream unchanged. If the
+// client didn't send one, identity is requested so that
+// http.Transport doesn't ask for, and then transparently
+// decompress, gzip on its own.
+func (p *ReverseProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	ae, ok := req.Header["Accept-Encoding"]
+	if cr := clientRequest(req); cr != nil {
+		ae, ok = cr.Header["Accept-Encoding"]
+	}
+
+	if !ok {
+		ae = []string{"identity"}
+	}
+
+	if !equalStrings(ae, req.Header["Accept-Encoding"]) {
+		// RoundTrippers mustn't modify the request, so
+		// the header is changed on a copy.
+		r2 := new(http.Request)
+		*r2 = *req
+
+		r2.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			r2.Header[k] = v
+		}
+
+		r2.Header["Accept-Encoding"] = ae
+		req = r2
+	}
+
+	return p.transport.RoundTrip(req)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ModifyResponse is for use as the ModifyResponse
+// function of an httputil.ReverseProxy. It compresses or
+// transcodes the upstream response as needed for the
+// client's Accept-Encoding.
+func (p *ReverseProxy) ModifyResponse(res *http.Response) error {
+	if res.Request == nil {
+		return nil
+	}
+
+	r := clientRequest(res.Request)
+	if r == nil {
+		if len(p.c.compiled) != 0 {
+			return errNotWrapped
+		}
+
+		r = res.Request
+	}
+
+	c := p.c.configFor(r)
+
+	if !c.preciseVary {
+		addVary(res.Header)
+	}
+
+	codings := contentCodings(res.Header)
+	if !c.proxyEncodable(res, codings) {
+		return nil
+	}
+
+	ok, negotiated := c.shouldGzipRequest(r)
+	if negotiated && c.preciseVary {
+		addVary(res.Header)
+	}
+
+	target := ""
+	switch {
+	case ok:
+		target = "gzip"
+	case negotiated && httputils.Negotiate(r.Header, "Accept-Encoding", "deflate") == "deflate":
+		target = "deflate"
+	}
+
+	if len(codings) == 0 {
+		if target == "" {
+			return nil
+		}
+
+		return recode(c, res, res.Body, target)
+	}
+
+	coding := strings.ToLower(codings[0])
+	if coding == "x-gzip" {
+		coding = "gzip"
+	}
+
+	if target == "" || target == coding ||
+		negotiated && httputils.Negotiate(r.Header, "Accept-Encoding", coding) == coding {
+		return nil
+	}
+
+	return transcode(c, res, coding, target)
+}
+
+// proxyEncodable reports whether c allows res to be
+// compressed, or transcoded, for a client that accepts it.
+func (c *config) proxyEncodable(res *http.Response, codings []string) bool {
+	if !hasResponseBody(res) ||
+		(c.noTransform != IgnoreNoTransform && hasNoTransform(res.Header)) ||
+		res.StatusCode == http.StatusPartialContent ||
+		res.Header.Get("Content-Range") != "" ||
+		!c.handlesStatusCode(res.StatusCode) {
+		return false
+	}
+
+	switch len(codings) {
+	case 0:
+	case 1:
+		switch strings.ToLower(codings[0]) {
+		case "gzip", "x-gzip", "deflate":
+			return true
+		}
+
+		fallthrough
+	default:
+		return false
+	}
+
+	if !c.handlesContentType(res.Header) {
+		return false
+	}
+
+	minSize := c.minSize
+	if rule := c.contentTypeRuleFor(res.Header); rule != nil {
+		minSize = rule.minSize
+	}
+
+	return res.ContentLength < 0 || res.ContentLength >= int64(minSize)
+}
+
+func transcode(c *config, res *http.Response, coding, target string) error {
+	var src io.Reader
+	if coding == "gzip" {
+		zr, _ := gzipReaderPool.Get().(*gzip.Reader)
+		if zr == nil {
+			zr = new(gzip.Reader)
+		}
+
+		if err := zr.Reset(res.Body); err != nil {
+			gzipReaderPool.Put(zr)
+			return err
+		}
+
+		src = zr
+	} else {
+		zr, err := zlib.NewReader(res.Body)
+		if err != nil {
+			return err
+		}
+
+		src = zr
+	}
+
+	return recode(c, res, src, target)
+}
+
+// proxyLevel returns the compression level for res.
+func (c *config) proxyLevel(res *http.Response) int {
+	level := c.level
+
+	if res.ContentLength >= 0 {
+		if tier, ok := c.sizeTierLevel(res.ContentLength); ok {
+			level = tier
+		}
+	}
+
+	if rule := c.contentTypeRuleFor(res.Header); rule != nil {
+		level = rule.level
+	}
+
+	return level
+}
+
+// recode replaces the body of res with src encoded with
+// coding, and updates the headers to match.
+func recode(c *config, res *http.Response, src io.Reader, coding string) error {
+	level := c.proxyLevel(res)
+
+	er := &encodeReader{
+		src:   src,
+		body:  res.Body,
+		level: level,
+		chunk: make([]byte, 32*1024),
+	}
+
+	if coding == "gzip" {
+		er.gw = gzipWriterGet(&er.buf, level)
+		er.enc = er.gw
+	} else {
+		zw, err := zlib.NewWriterLevel(&er.buf, level)
+		if err != nil {
+			return err
+		}
+
+		er.enc = zw
+	}
+
+	res.Body = er
+	res.ContentLength = -1
+
+	h := res.Header
+	h.Set("Content-Encoding", coding)
+
+	// The length isn't known until the response has been
+	// encoded, and ranges and digests refer to the
+	// upstream bytes.
+	dropEncodedFields(h)
+
+	// The encoded response is a different representation,
+	// so it mustn't share an ETag with the upstream
+	// response.
+	suffixETag(h, "-"+coding)
+
+	return nil
+}
+
+func hasResponseBody(res *http.Response) bool {
+	switch {
+	case res.Request.Method == http.MethodHead,
+		isInformational(res.StatusCode),
+		res.StatusCode == http.StatusNoContent,
+		res.StatusCode == http.StatusNotModified,
+		res.Body == nil,
+		res.Body == http.NoBody,
+		res.ContentLength == 0:
+		return false
+	default:
+		return true
+	}
+}
+
+// encodeWriter is implemented by both *gzip.Writer and
+// *zlib.Writer.
+type encodeWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encodeReader encodes src as it's read. Each chunk read
+// from src is flushed through the encoder so that
+// streamed responses aren't held up waiting for more
+// input.
+type encodeReader struct {
+	src  io.Reader
+	body io.ReadCloser
+
+	enc   encodeWriter
+	gw    *gzip.Writer // enc, if it came from a gzip pool
+	level int
+
+	buf   bytes.Buffer
+	chunk []byte
+	err   error
+}
+
+func (er *encodeReader) Read(p []byte) (int, error) {
+	for er.buf.Len() == 0 && er.err == nil {
+		er.fill()
+	}
+
+	if er.buf.Len() != 0 {
+		return er.buf.Read(p)
+	}
+
+	return 0, er.err
+}
+
+func (er *encodeReader) fill() {
+	n, err := er.src.Read(er.chunk)
+	if n != 0 {
+		if _, werr := er.enc.Write(er.chunk[:n]); werr != nil {
+			er.err = werr
+			return
+		}
+	}
+
+	switch {
+	case err == io.EOF:
+		if er.err = er.enc.Close(); er.err == nil {
+			er.err = io.EOF
+		}
+
+		er.release()
+	case err != nil:
+		er.err = err
+	case n != 0:
+		er.err = er.enc.Flush()
+	}
+}
+
+func (er *encodeReader) release() {
+	if er.gw != nil {
+		gzipWriterPut(er.gw, er.level)
+		er.gw = nil
+	}
+
+	if zr, ok := er.src.(*gzip.Reader); ok {
+		gzipReaderPool.Put(zr)
+		er.src = nil
+	}
+}
+
+func (er *encodeReader) Close() error {
+	if er.err == nil {
+		er.err = errBodyClosed
+	}
+
+	er.release()
+	return er.body.Close()
+}
@@ -0,0 +1,306 @@
+package gziphandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newProxyTest returns a reverse proxy in front of an
+// upstream that serves body with the given
+// Content-Encoding, ignoring Accept-Encoding. The
+// Accept-Encoding the upstream received is stored in ae.
+// The upstream is mounted under /upstream, so the proxy's
+// Director rewrites every path. The returned server must be
+// closed by the caller.
+func newProxyTest(t *testing.T, coding string, body []byte, ae *string, opts ...Option) (http.Handler, *httptest.Server) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*ae = r.Header.Get("Accept-Encoding")
+		assert.True(t, strings.HasPrefix(r.URL.Path, "/upstream/"), r.URL.Path)
+
+		h := w.Header()
+		if coding != "" {
+			h.Set("Content-Encoding", coding)
+		}
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("ETag", `"abc"`)
+
+		_, err := w.Write(body)
+		assert.NoError(t, err)
+	}))
+
+	u, err := url.Parse(upstream.URL + "/upstream")
+	require.NoError(t, err)
+
+	rp, err := NewReverseProxy(nil, opts...)
+	require.NoError(t, err)
+
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = rp
+	proxy.ModifyResponse = rp.ModifyResponse
+	return rp.Wrap(proxy), upstream
+}
+
+func proxyGet(handler http.Handler, acceptEncoding string) *http.Response {
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp.Result()
+}
+
+func deflateStr(s string) []byte {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	io.WriteString(w, s)
+	w.Close()
+	return b.Bytes()
+}
+
+func TestReverseProxyPassThrough(t *testing.T) {
+	var ae string
+	body := gzipStrLevel(testBody, BestSpeed)
+	handler, srv := newProxyTest(t, "gzip", body, &ae)
+	defer srv.Close()
+
+	res := proxyGet(handler, "gzip, deflate")
+	assert.Equal(t, "gzip, deflate", ae)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(body)), res.Header.Get("Content-Length"))
+	assert.Equal(t, `"abc"`, res.Header.Get("ETag"))
+
+	got, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, got)
+}
+
+func TestReverseProxyCompress(t *testing.T) {
+	var ae string
+	handler, srv := newProxyTest(t, "", []byte(testBody), &ae)
+	defer srv.Close()
+
+	res := proxyGet(handler, "gzip")
+	assert.Equal(t, "gzip", ae)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header.Get("Content-Length"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, `"abc-gzip"`, res.Header.Get("ETag"))
+
+	zr, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, testBody, string(got))
+
+	res = proxyGet(handler, "deflate")
+	assert.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"abc-deflate"`, res.Header.Get("ETag"))
+
+	zr2, err := zlib.NewReader(res.Body)
+	require.NoError(t, err)
+	got, err = ioutil.ReadAll(zr2)
+	require.NoError(t, err)
+	assert.Equal(t, testBody, string(got))
+}
+
+func TestReverseProxyNoAcceptEncoding(t *testing.T) {
+	var ae string
+	handler, srv := newProxyTest(t, "", []byte(testBody), &ae)
+	defer srv.Close()
+
+	res := proxyGet(handler, "")
+	assert.Equal(t, "identity", ae)
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(testBody)), res.Header.Get("Content-Length"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, `"abc"`, res.Header.Get("ETag"))
+
+	got, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, testBody, string(got))
+}
+
+func TestReverseProxyTranscode(t *testing.T) {
+	var ae string
+
+	handler, srv := newProxyTest(t, "gzip", gzipStrLevel(testBody, BestSpeed), &ae)
+	defer srv.Close()
+	res := proxyGet(handler, "deflate")
+	assert.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "", res.Header.Get("Content-Length"))
+	assert.Equal(t, `"abc-deflate"`, res.Header.Get("ETag"))
+
+	zr, err := zlib.NewReader(res.Body)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, testBody, string(got))
+
+	handler, srv = newProxyTest(t, "deflate", deflateStr(testBody), &ae)
+	defer srv.Close()
+	res = proxyGet(handler, "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"abc-gzip"`, res.Header.Get("ETag"))
+
+	zr2, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+	got, err = ioutil.ReadAll(zr2)
+	require.NoError(t, err)
+	assert.Equal(t, testBody, string(got))
+}
+
+func TestReverseProxyUnknownCoding(t *testing.T) {
+	var ae string
+	body := []byte("not really brotli")
+	handler, srv := newProxyTest(t, "br", body, &ae)
+	defer srv.Close()
+
+	res := proxyGet(handler, "gzip")
+	assert.Equal(t, "br", res.Header.Get("Content-Encoding"))
+
+	got, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, got)
+}
+
+func TestReverseProxyOptions(t *testing.T) {
+	var ae string
+
+	handler, srv := newProxyTest(t, "", []byte("tiny"), &ae)
+	defer srv.Close()
+	res := proxyGet(handler, "gzip")
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"), "below MinSize")
+
+	handler, srv = newProxyTest(t, "", []byte(testBody), &ae,
+		ExcludeContentTypes([]string{"text/plain"}))
+	defer srv.Close()
+	res = proxyGet(handler, "gzip")
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"), "excluded content type")
+
+	handler, srv = newProxyTest(t, "", []byte("tiny"), &ae,
+		PerContentType([]string{"text/plain"}, BestSpeed, 0))
+	defer srv.Close()
+	res = proxyGet(handler, "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "PerContentType minimum size")
+
+	// NoCompression makes the response bigger than the
+	// upstream's.
+	handler, srv = newProxyTest(t, "", []byte(testBody), &ae,
+		SizeTiers(SizeTier{Size: 1, Level: NoCompression}))
+	defer srv.Close()
+	res = proxyGet(handler, "gzip")
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Greater(t, len(body), len(testBody), "SizeTiers level")
+
+	handler, srv = newProxyTest(t, "", []byte("tiny"), &ae, PreciseVary(true))
+	defer srv.Close()
+	res = proxyGet(handler, "gzip")
+	assert.Nil(t, res.Header["Vary"], "PreciseVary")
+
+	handler, srv = newProxyTest(t, "", []byte(testBody), &ae, PreciseVary(true))
+	defer srv.Close()
+	res = proxyGet(handler, "")
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"), "PreciseVary")
+
+	_, err = NewReverseProxy(nil, MinSize(-1))
+	assert.Error(t, err)
+}
+
+func TestReverseProxyUnsupportedOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  Option
+	}{
+		{"MaxBufferSize", MaxBufferSize(4096)},
+		{"CompressionRatio", CompressionRatio(512, 0.9)},
+		{"OnFallback", OnFallback(func(*http.Request, int, int) {})},
+		{"ShouldCompressResponse", ShouldCompressResponse(func(*http.Request, int, http.Header, []byte) Decision {
+			return Decision{}
+		})},
+		{"Digest", Digest(SHA256)},
+		{"StackEncodings", StackEncodings(true)},
+		{"Gunzip", Gunzip(1 << 20)},
+		{"ErrorHandler", ErrorHandler(func(*http.Request, *ResponseError) {})},
+	} {
+		_, err := NewReverseProxy(nil, tc.opt)
+		assert.EqualError(t, err, "gziphandler: "+tc.name+" is not supported by ReverseProxy")
+
+		_, err = NewReverseProxy(nil, WithRules(Rules{{Options: []Option{tc.opt}}}))
+		assert.EqualError(t, err, "gziphandler: rule 0: "+tc.name+" is not supported by ReverseProxy")
+	}
+}
+
+func TestReverseProxyRules(t *testing.T) {
+	var ae string
+	handler, srv := newProxyTest(t, "", []byte(testBody), &ae,
+		WithRules(Rules{{Match: PathPrefix("/raw/"), Options: []Option{ShouldGzip(skipGzip)}}}))
+	defer srv.Close()
+
+	// The rule matches the client's path, not the path
+	// rewritten by the Director.
+	req := httptest.NewRequest(http.MethodGet, "/raw/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, "", resp.Header().Get("Content-Encoding"))
+	assert.Equal(t, testBody, resp.Body.String())
+
+	res := proxyGet(handler, "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+}
+
+func TestReverseProxyNotWrapped(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		opts   []Option
+		status int
+	}{
+		{nil, http.StatusOK},
+		{[]Option{WithRules(Rules{{Match: PathPrefix("/raw/")}})}, http.StatusBadGateway},
+	} {
+		rp, err := NewReverseProxy(nil, tc.opts...)
+		require.NoError(t, err)
+
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.Transport = rp
+		proxy.ModifyResponse = rp.ModifyResponse
+		proxy.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+		res := proxyGet(proxy, "gzip")
+		assert.Equal(t, tc.status, res.StatusCode)
+	}
+}
+
+func TestReverseProxyCorrupt(t *testing.T) {
+	var ae string
+	handler, srv := newProxyTest(t, "gzip", []byte("not gzip"), &ae)
+	defer srv.Close()
+
+	res := proxyGet(handler, "deflate")
+	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+}
@@ -0,0 +1,150 @@
+package gziphandler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Matcher reports whether a Rule applies to a request.
+type Matcher func(r *http.Request) bool
+
+// Rule selects a set of options for the requests it
+// matches.
+type Rule struct {
+	// Match reports whether the rule applies to a
+	// request. A nil Match matches every request.
+	Match Matcher
+
+	// Options are applied on top of the handler's own
+	// options for requests that match.
+	Options []Option
+}
+
+// Rules is an ordered list of rules. The first rule that
+// matches a request is used.
+type Rules []Rule
+
+// WithRules selects the options to apply to each request
+// from rules. Requests that don't match any rule use the
+// handler's options.
+//
+// The options for each rule are combined with the
+// handler's options once, when the handler is created, so
+// only the matchers are evaluated for each request. The
+// handler's options are always applied first, regardless
+// of where WithRules appears. Rules cannot be nested.
+func WithRules(rules Rules) Option {
+	rules = append(Rules(nil), rules...)
+
+	return func(c *config) {
+		c.rules = rules
+	}
+}
+
+type compiledRule struct {
+	match Matcher
+	config
+}
+
+func compileRules(base *config) ([]compiledRule, error) {
+	if len(base.rules) == 0 {
+		return nil, nil
+	}
+
+	compiled := make([]compiledRule, len(base.rules))
+	for i, rule := range base.rules {
+		cr := &compiled[i]
+
+		cr.match = rule.Match
+		if cr.match == nil {
+			cr.match = matchAll
+		}
+
+		cr.config = *base
+		cr.config.rules = nil
+
+		for _, opt := range rule.Options {
+			opt(&cr.config)
+		}
+
+		if cr.config.rules != nil {
+			return nil, fmt.Errorf("rule %d: rules cannot be nested", i)
+		}
+
+		if err := cr.config.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+
+	return compiled, nil
+}
+
+func matchAll(*http.Request) bool { return true }
+
+// PathPrefix returns a Matcher that matches requests whose
+// URL path begins with prefix.
+func PathPrefix(prefix string) Matcher {
+	return func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+}
+
+// Methods returns a Matcher that matches requests with any
+// of the given methods.
+func Methods(methods ...string) Matcher {
+	methods = append([]string(nil), methods...)
+
+	return func(r *http.Request) bool {
+		for _, method := range methods {
+			if r.Method == method {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// Pattern returns a Matcher that matches requests routed by
+// mux to any of the given patterns, e.g. "GET /static/".
+//
+// If the request has already been routed by a ServeMux, as
+// is the case when the handler is registered with one, the
+// pattern it matched is used. Otherwise, which is the case
+// when the handler wraps mux, the pattern is looked up in
+// mux. mux may be nil in the former case.
+func Pattern(mux *http.ServeMux, patterns ...string) Matcher {
+	patterns = append([]string(nil), patterns...)
+
+	return func(r *http.Request) bool {
+		pattern := requestPattern(r)
+		if pattern == "" && mux != nil {
+			_, pattern = mux.Handler(r)
+		}
+
+		for _, p := range patterns {
+			if pattern == p {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// All returns a Matcher that matches requests that every
+// one of matchers matches.
+func All(matchers ...Matcher) Matcher {
+	matchers = append([]Matcher(nil), matchers...)
+
+	return func(r *http.Request) bool {
+		for _, match := range matchers {
+			if !match(r) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
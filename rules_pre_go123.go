@@ -0,0 +1,12 @@
+//go:build !go1.23
+// +build !go1.23
+
+package gziphandler
+
+import "net/http"
+
+// requestPattern returns the ServeMux pattern that matched
+// r, if any. Request.Pattern was added in go1.23.
+func requestPattern(r *http.Request) string {
+	return ""
+}
@@ -0,0 +1,73 @@
+package gziphandler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRules(t *testing.T) {
+	body := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", body)
+	mux.HandleFunc("/metrics", body)
+	mux.HandleFunc("/static/", body)
+	mux.HandleFunc("/api/", body)
+
+	skip := ShouldGzip(func(*http.Request) ShouldGzipType {
+		return SkipGzip
+	})
+
+	handler := Gzip(mux, WithRules(Rules{
+		{Match: PathPrefix("/metrics"), Options: []Option{skip}},
+		{Match: Pattern(mux, "/static/"), Options: []Option{CompressionLevel(BestCompression)}},
+		{Match: All(PathPrefix("/api/"), Methods(http.MethodPost)), Options: []Option{MinSize(len(testBody) + 1)}},
+	}), CompressionLevel(BestSpeed))
+
+	for _, tc := range []struct {
+		method, path string
+		expect       bool
+		level        int
+	}{
+		{http.MethodGet, "/", true, BestSpeed},
+		{http.MethodGet, "/metrics", false, 0},
+		{http.MethodGet, "/static/app.css", true, BestCompression},
+		{http.MethodGet, "/api/users", true, BestSpeed},
+		{http.MethodPost, "/api/users", false, 0},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+
+		res := resp.Result()
+		assert.Equal(t, http.StatusOK, res.StatusCode, "%+v", tc)
+
+		if tc.expect {
+			assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "%+v", tc)
+			assert.Equal(t, gzipStrLevel(testBody, tc.level), resp.Body.Bytes(), "%+v", tc)
+		} else {
+			assert.Equal(t, "", res.Header.Get("Content-Encoding"), "%+v", tc)
+			assert.Equal(t, testBody, resp.Body.String(), "%+v", tc)
+		}
+	}
+}
+
+func TestRulesInvalid(t *testing.T) {
+	_, err := New(new(dummyHTTPHandler), WithRules(Rules{
+		{Options: []Option{WithRules(Rules{{}})}},
+	}))
+	assert.EqualError(t, err, "gziphandler: rule 0: rules cannot be nested")
+
+	_, err = New(new(dummyHTTPHandler), WithRules(Rules{
+		{Options: []Option{CompressionLevel(BestSpeed)}},
+		{Options: []Option{MinSize(-10)}},
+	}))
+	assert.EqualError(t, err, "gziphandler: rule 1: minimum size must not be negative: -10")
+}
@@ -0,0 +1,45 @@
+//go:build go1.21
+// +build go1.21
+
+package gziphandler
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Logger reports errors encountered while writing responses
+// to l, with the request method and path, whether the
+// response was being compressed, the compression level and
+// the number of bytes written as attributes.
+//
+// Errors caused by the client going away, such as a broken
+// pipe or a connection reset, are logged at the debug level
+// and other errors at the error level.
+//
+// Logger replaces any ErrorHandler.
+func Logger(l *slog.Logger) Option {
+	if l == nil {
+		return errorOption("nil logger given to Logger")
+	}
+
+	return ErrorHandler(func(r *http.Request, err *ResponseError) {
+		level := slog.LevelError
+		if isDisconnect(r, err.Err) {
+			level = slog.LevelDebug
+		}
+
+		decision := "identity"
+		if err.Compressed {
+			decision = "gzip"
+		}
+
+		l.LogAttrs(r.Context(), level, "gziphandler: error during "+err.Op,
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("decision", decision),
+			slog.Int("compression_level", err.Level),
+			slog.Int64("bytes_written", err.BytesWritten),
+			slog.Any("error", err.Err))
+	})
+}
@@ -0,0 +1,63 @@
+//go:build go1.21
+// +build go1.21
+
+package gziphandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	for _, tc := range []struct {
+		err   error
+		level string
+	}{
+		{errors.New("write failed"), "ERROR"},
+		{syscall.EPIPE, "DEBUG"},
+	} {
+		buf.Reset()
+
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody[:10])
+			io.WriteString(w, testBody[10:])
+		}), CompressionLevel(BestSpeed), Logger(logger))
+
+		req := httptest.NewRequest(http.MethodPost, "/export", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(errorRecorder{httptest.NewRecorder(), tc.err}, req)
+
+		// The write error is sticky, so only the failed
+		// write is logged, not the close that follows it.
+		dec := json.NewDecoder(&buf)
+		var record map[string]interface{}
+		require.NoError(t, dec.Decode(&record), "%v", tc.err)
+		assert.Equal(t, tc.level, record["level"])
+		assert.Equal(t, "gziphandler: error during write", record["msg"])
+		assert.Equal(t, "POST", record["method"])
+		assert.Equal(t, "/export", record["path"])
+		assert.Equal(t, "gzip", record["decision"])
+		assert.Equal(t, float64(BestSpeed), record["compression_level"])
+		assert.Equal(t, float64(10), record["bytes_written"])
+		assert.Equal(t, tc.err.Error(), record["error"])
+		assert.Equal(t, io.EOF, dec.Decode(new(interface{})), "%v", tc.err)
+	}
+}
+
+func TestLoggerNil(t *testing.T) {
+	_, err := New(new(dummyHTTPHandler), Logger(nil))
+	assert.EqualError(t, err, "gziphandler: nil logger given to Logger")
+}
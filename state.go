@@ -0,0 +1,122 @@
+package gziphandler
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrClosed is returned by Write once the wrapped
+	// handler has returned and the response has been
+	// closed.
+	ErrClosed = errors.New("gziphandler: write after response closed")
+
+	// ErrHijackCommitted is returned by Hijack once part
+	// of the response body has been written to the
+	// connection.
+	ErrHijackCommitted = errors.New("gziphandler: cannot hijack after the response body was written")
+)
+
+// state is the state of a responseWriter.
+//
+// A response starts out buffering and commits to exactly one
+// of gzip, gunzip or pass through. It may be hijacked from any state
+// that isn't closed, and ends up closed.
+type state int
+
+const (
+	// stateBuffering holds writes in buf until we can
+	// decide whether to compress the response.
+	stateBuffering state = iota
+
+	// stateGzip compresses writes with gw.
+	stateGzip
+
+	// statePassThrough writes the response as-is.
+	statePassThrough
+
+	// stateGunzip decompresses writes with gunzipper,
+	// see Gunzip.
+	stateGunzip
+
+	// stateHijacked means the handler has taken over
+	// the connection.
+	stateHijacked
+
+	// stateClosed means the response has finished, or
+	// has been abandoned if err is set.
+	stateClosed
+)
+
+func (s state) String() string {
+	switch s {
+	case stateBuffering:
+		return "buffering"
+	case stateGzip:
+		return "gzip"
+	case statePassThrough:
+		return "pass through"
+	case stateGunzip:
+		return "gunzip"
+	case stateHijacked:
+		return "hijacked"
+	case stateClosed:
+		return "closed"
+	default:
+		return "state(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// canMoveTo reports whether a response may move from s
+// to the given state.
+func (s state) canMoveTo(to state) bool {
+	switch s {
+	case stateBuffering:
+		return to != stateBuffering
+	case stateGzip, stateGunzip, statePassThrough:
+		return to == stateHijacked || to == stateClosed
+	case stateHijacked:
+		return to == stateClosed
+	default:
+		return false
+	}
+}
+
+// setState moves the response to the given state, or
+// returns an error if that transition is illegal.
+func (w *responseWriter) setState(to state) error {
+	if !w.state.canMoveTo(to) {
+		return invariantError("illegal transition from " + w.state.String() + " to " + to.String())
+	}
+
+	w.state = to
+	return nil
+}
+
+// checkState returns an error if buf and gw don't match the
+// state of the response. op is the method being called.
+func (w *responseWriter) checkState(op string) error {
+	switch {
+	case w.buf != nil && w.gw != nil:
+		return invariantError("both buf and gw are non nil in call to " + op)
+	case (w.buf != nil) != (w.state == stateBuffering),
+		(w.gw != nil) != (w.state == stateGzip),
+		(w.gunzipper != nil) != (w.state == stateGunzip):
+		return invariantError("buf and gw are inconsistent with " + w.state.String() + " state in call to " + op)
+	default:
+		return nil
+	}
+}
+
+// invariantError returns an error describing a violation
+// of the responseWriter's invariants. If built with the
+// gziphandler_debug tag, it panics instead.
+func invariantError(msg string) error {
+	msg = "gziphandler: " + msg
+
+	if debugInvariants {
+		panic(msg)
+	}
+
+	return errors.New(msg)
+}
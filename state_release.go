@@ -0,0 +1,8 @@
+//go:build !gziphandler_debug
+// +build !gziphandler_debug
+
+package gziphandler
+
+// debugInvariants makes violations of the responseWriter's
+// invariants panic rather than return an error.
+const debugInvariants = false
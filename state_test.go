@@ -0,0 +1,260 @@
+package gziphandler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newInconsistentResponseWriter returns a responseWriter
+// that is both buffering and gzipping.
+func newInconsistentResponseWriter() *responseWriter {
+	return &responseWriter{
+		ResponseWriter: httptest.NewRecorder(),
+
+		c: new(config),
+		r: httptest.NewRequest(http.MethodGet, "/whatever", nil),
+
+		gw:  new(gzip.Writer),
+		buf: new([]byte),
+	}
+}
+
+func TestReleaseBufferInvariant(t *testing.T) {
+	const msg = "gziphandler: w.buf is nil in call to emptyBuffer"
+
+	if debugInvariants {
+		assert.PanicsWithValue(t, msg, func() {
+			new(responseWriter).releaseBuffer()
+		}, "releaseBuffer did not panic with nil buf")
+		return
+	}
+
+	assert.EqualError(t, new(responseWriter).releaseBuffer(), msg)
+}
+
+func TestWriteInvariant(t *testing.T) {
+	const msg = "gziphandler: both buf and gw are non nil in call to Write"
+
+	if debugInvariants {
+		assert.PanicsWithValue(t, msg, func() {
+			newInconsistentResponseWriter().Write(nil)
+		}, "Write did not panic with both gw and buf non-nil")
+		return
+	}
+
+	_, err := newInconsistentResponseWriter().Write(nil)
+	assert.EqualError(t, err, msg)
+}
+
+func TestCloseInvariant(t *testing.T) {
+	const msg = "gziphandler: both buf and gw are non nil in call to Close"
+
+	if debugInvariants {
+		assert.PanicsWithValue(t, msg, func() {
+			newInconsistentResponseWriter().Close()
+		}, "Close did not panic with both gw and buf non-nil")
+		return
+	}
+
+	w := newInconsistentResponseWriter()
+	assert.EqualError(t, w.Close(), msg)
+	assert.Equal(t, stateClosed, w.state)
+
+	_, err := w.Write(nil)
+	assert.EqualError(t, err, msg, "Write after failed Close")
+}
+
+func TestStateInvariant(t *testing.T) {
+	w := &responseWriter{state: statePassThrough, buf: new([]byte)}
+
+	const msg = "gziphandler: buf and gw are inconsistent with pass through state in call to Flush"
+	if debugInvariants {
+		assert.PanicsWithValue(t, msg, func() {
+			w.checkState("Flush")
+		})
+		return
+	}
+
+	assert.EqualError(t, w.checkState("Flush"), msg)
+}
+
+func TestStateTransitions(t *testing.T) {
+	for _, tc := range []struct {
+		from, to state
+		ok       bool
+	}{
+		{stateBuffering, stateGzip, true},
+		{stateBuffering, statePassThrough, true},
+		{stateBuffering, stateHijacked, true},
+		{stateBuffering, stateClosed, true},
+		{stateBuffering, stateBuffering, false},
+		{stateGzip, statePassThrough, false},
+		{stateGzip, stateHijacked, true},
+		{stateGzip, stateClosed, true},
+		{statePassThrough, stateGzip, false},
+		{statePassThrough, stateClosed, true},
+		{stateHijacked, stateGzip, false},
+		{stateHijacked, stateClosed, true},
+		{stateClosed, stateBuffering, false},
+		{stateClosed, stateClosed, false},
+	} {
+		assert.Equal(t, tc.ok, tc.from.canMoveTo(tc.to), "%s -> %s", tc.from, tc.to)
+	}
+
+	if !debugInvariants {
+		w := &responseWriter{state: statePassThrough}
+		assert.EqualError(t, w.setState(stateGzip),
+			"gziphandler: illegal transition from pass through to gzip")
+		assert.Equal(t, statePassThrough, w.state)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	var rw http.ResponseWriter
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw = w
+		io.WriteString(w, testBody)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	_, err := rw.Write([]byte(testBody))
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), resp.Body.Bytes())
+
+	rw.(http.Flusher).Flush()
+	assert.Equal(t, gzipStrLevel(testBody, DefaultCompression), resp.Body.Bytes())
+}
+
+// hijackRecorder is an httptest.ResponseRecorder that
+// implements http.Hijacker.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+
+	server, client := net.Pipe()
+	client.Close()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func TestWriteAfterHijack(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = io.WriteString(w, testBody)
+		assert.Equal(t, http.ErrHijacked, err)
+
+		rw := w.(hijackResponseWriter).responseWriter
+		assert.Equal(t, stateHijacked, rw.state)
+		assert.Nil(t, rw.buf)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(rec, req)
+
+	assert.True(t, rec.hijacked)
+	assert.Equal(t, 0, rec.Body.Len())
+}
+
+func TestHijackCommitted(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		encoding    string
+	}{
+		{"gzip", "text/plain", "gzip"},
+		{"pass through", "image/png", ""},
+	} {
+		handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tc.contentType)
+			io.WriteString(w, testBody)
+
+			_, _, err := w.(http.Hijacker).Hijack()
+			assert.Equal(t, ErrHijackCommitted, err, tc.name)
+
+			_, err = io.WriteString(w, testBody)
+			assert.NoError(t, err, tc.name)
+		}), ContentTypes([]string{"text/plain"}))
+
+		req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(rec, req)
+
+		assert.False(t, rec.hijacked, tc.name)
+		assert.Equal(t, tc.encoding, rec.Header().Get("Content-Encoding"), tc.name)
+
+		if tc.encoding == "" {
+			assert.Equal(t, testBody+testBody, rec.Body.String(), tc.name)
+		} else {
+			assert.Equal(t, gzipStrLevel(testBody+testBody, DefaultCompression), rec.Body.Bytes(), tc.name)
+		}
+	}
+}
+
+func TestHijackBuffered(t *testing.T) {
+	handler := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+
+		rw := w.(hijackResponseWriter).responseWriter
+		assert.Equal(t, stateHijacked, rw.state)
+		assert.Nil(t, rw.buf)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/whatever", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(rec, req)
+
+	assert.True(t, rec.hijacked)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "hello", rec.Body.String(), "buffered body should be sent uncompressed")
+}
+
+func TestCloseAfterHijack(t *testing.T) {
+	w := &responseWriter{
+		ResponseWriter: &hijackRecorder{ResponseRecorder: httptest.NewRecorder()},
+
+		c: new(config),
+		r: httptest.NewRequest(http.MethodGet, "/whatever", nil),
+
+		stats: new(counters),
+
+		buf: bufferPool.Get().(*[]byte),
+	}
+
+	conn, _, err := w.hijack()
+	require.NoError(t, err)
+	conn.Close()
+
+	assert.NoError(t, w.Close())
+	assert.Equal(t, stateClosed, w.state)
+	assert.NoError(t, w.Close(), "second Close")
+
+	_, _, err = w.hijack()
+	assert.EqualError(t, err, "gziphandler: cannot hijack a response that is closed")
+}
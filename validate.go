@@ -0,0 +1,132 @@
+package gziphandler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// errorOption returns an Option that reports an invalid
+// value to New.
+func errorOption(format string, args ...interface{}) Option {
+	err := fmt.Errorf(format, args...)
+
+	return func(c *config) {
+		if c.err == nil {
+			c.err = err
+		}
+	}
+}
+
+func validLevel(level int) bool {
+	return level >= HuffmanOnly && level <= BestCompression
+}
+
+// validate returns the first error reported by an Option,
+// or an error if the options contradict each other.
+func (c *config) validate() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	for _, typ := range c.contentTypes {
+		if !validMIMEPattern(typ) {
+			return fmt.Errorf("invalid MIME type given to ContentTypes: %q", typ)
+		}
+	}
+
+	for _, typ := range c.excludeContentTypes {
+		if !validMIMEPattern(typ) {
+			return fmt.Errorf("invalid MIME type given to ExcludeContentTypes: %q", typ)
+		}
+	}
+
+	if len(c.contentTypes) != 0 && mimePatternsCovered(c.contentTypes, c.excludeContentTypes) {
+		return fmt.Errorf("ContentTypes %q are all excluded by ExcludeContentTypes %q",
+			c.contentTypes, c.excludeContentTypes)
+	}
+
+	for _, rule := range c.contentTypeRules {
+		for _, typ := range rule.types {
+			if !validMIMEPattern(typ) {
+				return fmt.Errorf("invalid MIME type given to PerContentType: %q", typ)
+			}
+		}
+
+		if len(c.contentTypes) != 0 && !mimePatternsOverlap(rule.types, c.contentTypes) {
+			return fmt.Errorf("PerContentType %q never applies as it is excluded by ContentTypes %q",
+				rule.types, c.contentTypes)
+		}
+
+		if mimePatternsCovered(rule.types, c.excludeContentTypes) {
+			return fmt.Errorf("PerContentType %q never applies as it is excluded by ExcludeContentTypes %q",
+				rule.types, c.excludeContentTypes)
+		}
+	}
+
+	return nil
+}
+
+// validMIMEPattern reports whether typ is a MIME type, or a
+// MIME type with a wildcard subtype, as accepted by
+// ContentTypes.
+func validMIMEPattern(typ string) bool {
+	major, minor := splitMIMEPattern(typ)
+	return major != "" && minor != "" && !strings.ContainsAny(major+minor, "/;, \t")
+}
+
+func splitMIMEPattern(typ string) (major, minor string) {
+	idx := strings.IndexByte(typ, '/')
+	if idx < 0 {
+		return "", ""
+	}
+
+	return typ[:idx], typ[idx+1:]
+}
+
+// mimePatternsOverlap reports whether any MIME type could
+// match both a pattern in a and a pattern in b.
+func mimePatternsOverlap(a, b []string) bool {
+	for _, x := range a {
+		xMajor, xMinor := splitMIMEPattern(x)
+
+		for _, y := range b {
+			yMajor, yMinor := splitMIMEPattern(y)
+
+			if strings.EqualFold(xMajor, yMajor) &&
+				(xMinor == "*" || yMinor == "*" || strings.EqualFold(xMinor, yMinor)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// mimePatternsCovered reports whether every MIME type that
+// matches a pattern in a also matches a pattern in b.
+func mimePatternsCovered(a, b []string) bool {
+	if len(b) == 0 {
+		return false
+	}
+
+	for _, x := range a {
+		xMajor, xMinor := splitMIMEPattern(x)
+
+		covered := false
+		for _, y := range b {
+			yMajor, yMinor := splitMIMEPattern(y)
+
+			if strings.EqualFold(xMajor, yMajor) &&
+				(yMinor == "*" || xMinor != "*" && strings.EqualFold(xMinor, yMinor)) {
+				covered = true
+				break
+			}
+		}
+
+		if !covered {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,73 @@
+package gziphandler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	handler := new(dummyHTTPHandler)
+
+	h, err := New(handler, MinSize(42))
+	if assert.NoError(t, err) {
+		assert.Equal(t, Gzip(handler, MinSize(42)), h)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		opts []Option
+		err  string
+	}{
+		{[]Option{CompressionLevel(42)}, "invalid compression level requested: 42"},
+		{[]Option{MinSize(-10)}, "minimum size must not be negative: -10"},
+		{[]Option{MaxBufferSize(-10)}, "maximum buffer size must not be negative: -10"},
+		{[]Option{CompressionRatio(-10, 0.9)}, "look-ahead size must not be negative: -10"},
+		{[]Option{CompressionRatio(512, 0)}, "compression ratio must be positive: 0"},
+		{[]Option{Digest(SHA256, DigestAlgorithm(42))}, "invalid digest algorithm requested: 42"},
+		{[]Option{PerContentType([]string{"text/html"}, 42, 0)}, "invalid compression level requested: 42"},
+		{[]Option{PerContentType([]string{"text/html"}, BestSpeed, -10)}, "minimum size must not be negative: -10"},
+		{[]Option{SizeTiers(SizeTier{Size: 0, Level: 42})}, "invalid compression level requested: 42"},
+		{[]Option{SizeTiers(SizeTier{Size: -10, Level: BestSpeed})}, "tier size must not be negative: -10"},
+		{[]Option{StatusCodes(StatusCodeRange{299, 200})}, "invalid status code range requested: 299-200"},
+		{[]Option{StatusCodes(StatusCodeRange{0, 200})}, "invalid status code range requested: 0-200"},
+		{[]Option{ContentTypes([]string{"text"})}, `invalid MIME type given to ContentTypes: "text"`},
+		{[]Option{ContentTypes([]string{"text/html; charset=utf-8"})}, `invalid MIME type given to ContentTypes: "text/html; charset=utf-8"`},
+		{[]Option{PerContentType([]string{"/html"}, BestSpeed, 0)}, `invalid MIME type given to PerContentType: "/html"`},
+		{
+			[]Option{
+				ContentTypes([]string{"text/*", "application/json"}),
+				PerContentType([]string{"image/*", "application/xml"}, BestSpeed, 0),
+			},
+			`PerContentType ["image/*" "application/xml"] never applies as it is excluded by ContentTypes ["text/*" "application/json"]`,
+		},
+		{[]Option{ExcludeContentTypes([]string{"text/"})}, `invalid MIME type given to ExcludeContentTypes: "text/"`},
+		{
+			[]Option{
+				ExcludeContentTypes([]string{"image/*"}),
+				PerContentType([]string{"image/png", "image/svg+xml"}, BestSpeed, 0),
+			},
+			`PerContentType ["image/png" "image/svg+xml"] never applies as it is excluded by ExcludeContentTypes ["image/*"]`,
+		},
+		{[]Option{Gunzip(0)}, "gunzip size limit must be positive: 0"},
+		// The first error is reported.
+		{[]Option{MinSize(-10), CompressionLevel(42)}, "minimum size must not be negative: -10"},
+	} {
+		_, err := New(new(dummyHTTPHandler), tc.opts...)
+		assert.EqualError(t, err, "gziphandler: "+tc.err)
+	}
+}
+
+func TestNewValid(t *testing.T) {
+	for _, opts := range [][]Option{
+		{ContentTypes([]string{"text/*"}), PerContentType([]string{"text/html"}, BestSpeed, 0)},
+		{ContentTypes([]string{"text/html"}), PerContentType([]string{"Text/*"}, BestSpeed, 0)},
+		{ContentTypes([]string{"application/json"}), PerContentType([]string{"application/JSON"}, BestSpeed, 0)},
+		{ContentTypes([]string{"text/*"}), ExcludeContentTypes([]string{"text/event-stream"})},
+		{ExcludeContentTypes([]string{"text/event-stream"}), PerContentType([]string{"text/*"}, BestSpeed, 0)},
+	} {
+		_, err := New(new(dummyHTTPHandler), opts...)
+		assert.NoError(t, err)
+	}
+}